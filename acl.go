@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gopkg.in/yaml.v2"
+)
+
+// Permission is an action allowed on a state
+type Permission string
+
+// Permissions granted by the rules of an ACLPolicy. The admin permission includes all other permissions,
+// the read permission includes the read_outputs and read_redacted permissions.
+const (
+	PermissionRead         Permission = "read"
+	PermissionReadOutputs  Permission = "read_outputs"
+	PermissionReadRedacted Permission = "read_redacted"
+	PermissionWrite        Permission = "write"
+	PermissionLock         Permission = "lock"
+	PermissionDelete       Permission = "delete"
+	PermissionAdmin        Permission = "admin"
+)
+
+var knownPermissions = map[Permission]bool{
+	PermissionRead:         true,
+	PermissionReadOutputs:  true,
+	PermissionReadRedacted: true,
+	PermissionWrite:        true,
+	PermissionLock:         true,
+	PermissionDelete:       true,
+	PermissionAdmin:        true,
+}
+
+// includedPermissions are the permissions included in another permission besides the admin permission
+var includedPermissions = map[Permission][]Permission{
+	PermissionRead: {PermissionReadOutputs, PermissionReadRedacted},
+}
+
+// ACLRule grants the permissions on the states matching one of the path patterns
+// to the listed users and the members of the listed groups
+type ACLRule struct {
+	Users       []string     `yaml:"users"`
+	Groups      []string     `yaml:"groups"`
+	Paths       []string     `yaml:"paths"`
+	Permissions []Permission `yaml:"permissions"`
+}
+
+// ACLPolicy maps users and groups to the permissions on the states.
+// Everything not granted by a rule is denied.
+type ACLPolicy struct {
+	Groups map[string][]string `yaml:"groups"`
+	Rules  []ACLRule           `yaml:"rules"`
+}
+
+var accessPolicy *ACLPolicy
+
+// loadACLPolicy reads and validates the policy file
+func loadACLPolicy(filename string) (*ACLPolicy, error) {
+	var policy ACLPolicy
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(content, &policy); err != nil {
+		return nil, fmt.Errorf("can't parse acl file %s: %w", filename, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid acl file %s: %w", filename, err)
+	}
+
+	return &policy, nil
+}
+
+func (p *ACLPolicy) validate() error {
+	for i, rule := range p.Rules {
+		if err := validateGrant(rule.Paths, rule.Permissions); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// validateGrant checks the path patterns and permissions of a rule or token scope
+func validateGrant(patterns []string, permissions []Permission) error {
+	if len(patterns) == 0 {
+		return errors.New("no paths")
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q", pattern)
+		}
+	}
+	for _, permission := range permissions {
+		if !knownPermissions[permission] {
+			return fmt.Errorf("unknown permission %q", permission)
+		}
+	}
+
+	return nil
+}
+
+// memberOf returns the groups of the policy and of the identity the user is member of
+func (p *ACLPolicy) memberOf(identity *Identity) map[string]bool {
+	var groups = make(map[string]bool)
+
+	for _, group := range identity.Groups {
+		groups[group] = true
+	}
+	for group, members := range p.Groups {
+		for _, member := range members {
+			if member == identity.Name {
+				groups[group] = true
+			}
+		}
+	}
+
+	return groups
+}
+
+// allowed reports if one of the rules grants the permission on the state to the identity
+func (p *ACLPolicy) allowed(identity *Identity, tfID string, permission Permission) bool {
+	var groups = p.memberOf(identity)
+
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(identity.Name, groups) || !rule.grants(permission) {
+			continue
+		}
+		for _, pattern := range rule.Paths {
+			if matchStatePattern(pattern, normalizeStateID(tfID)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r ACLRule) appliesTo(username string, groups map[string]bool) bool {
+	for _, user := range r.Users {
+		if user == username || user == "*" {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		if groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ACLRule) grants(permission Permission) bool {
+	return grantsPermission(r.Permissions, permission)
+}
+
+// grantsPermission reports if the permission is one of the granted permissions or included in them
+func grantsPermission(granted []Permission, permission Permission) bool {
+	for _, grant := range granted {
+		if grant == permission || grant == PermissionAdmin {
+			return true
+		}
+		for _, included := range includedPermissions[grant] {
+			if included == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchStatePattern matches a state id like "team/project/env" against a pattern.
+// Every segment of the pattern is matched like path.Match, "**" matches any number of segments.
+func matchStatePattern(pattern string, tfID string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(tfID, "/"))
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// accessDenied returns the reason why the requesting user doesn't have the permission on the
+// state or an empty string if the access is allowed. The access is denied if the access policy
+// doesn't grant the permission or the permission is outside of the scopes of the used api token.
+// Without a policy all users have all permissions.
+func accessDenied(r *http.Request, tfID string, permission Permission) string {
+	identity := requestIdentity(r)
+	if identity == nil {
+		identity = &Identity{Name: "anonymous"}
+	}
+	switch {
+	case identity.Scopes != nil && !scopesAllow(identity.Scopes, tfID, permission):
+		return fmt.Sprintf("token of user %s has no %s scope on state %s", identity.Name, permission, tfID)
+	case accessPolicy != nil && !accessPolicy.allowed(identity, tfID, permission):
+		return fmt.Sprintf("user %s has no %s permission on state %s", identity.Name, permission, tfID)
+	}
+	return ""
+}
+
+// writeForbidden refuses the request with 403 and the reason
+func writeForbidden(w http.ResponseWriter, reason string) {
+	logger.Infof("Access denied: %s", reason)
+	authFailures.inc("forbidden")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte(http.StatusText(http.StatusForbidden) + ": " + reason))
+}
+
+// authorize is a middleware refusing requests for a state with 403 if the requesting user
+// doesn't have the permission on the state
+func authorize(permission Permission) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if reason := accessDenied(r, chi.URLParam(r, "id"), permission); reason != "" {
+				writeForbidden(w, reason)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
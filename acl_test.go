@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testACLPolicy = `
+groups:
+  auditors: [carol]
+rules:
+  - groups: [auditors]
+    paths: ["**"]
+    permissions: [read]
+  - users: [alice]
+    paths: ["team-a/**"]
+    permissions: [read, write, lock]
+  - users: [bob]
+    paths: ["team-b/*/prod"]
+    permissions: [admin]
+  - users: [erin]
+    paths: ["team-a/**"]
+    permissions: [read_outputs]
+  - users: [frank]
+    paths: ["team-a/**"]
+    permissions: [read_redacted]
+`
+
+func Test_loadACLPolicy(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "acl.yaml", testACLPolicy)
+	createFile(tmpTestDir, "unknown_permission.yaml", "rules:\n  - users: [alice]\n    paths: [\"**\"]\n    permissions: [execute]\n")
+	createFile(tmpTestDir, "missing_paths.yaml", "rules:\n  - users: [alice]\n    permissions: [read]\n")
+	createFile(tmpTestDir, "invalid_pattern.yaml", "rules:\n  - users: [alice]\n    paths: [\"team-[\"]\n    permissions: [read]\n")
+	createFile(tmpTestDir, "unknown_field.yaml", "rule:\n  - users: [alice]\n")
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"valid policy", "acl.yaml", false},
+		{"missing file", "missing.yaml", true},
+		{"unknown permission", "unknown_permission.yaml", true},
+		{"missing paths", "missing_paths.yaml", true},
+		{"invalid pattern", "invalid_pattern.yaml", true},
+		{"unknown field", "unknown_field.yaml", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := loadACLPolicy(tmpTestDir + tt.filename)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, policy.Rules, 5)
+		})
+	}
+}
+
+func Test_matchStatePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		tfID    string
+		want    bool
+	}{
+		{"**", "team/project/env", true},
+		{"team/**", "team/project/env", true},
+		{"team/**", "team", true},
+		{"team/**", "other/project", false},
+		{"team/*", "team/project", true},
+		{"team/*", "team/project/env", false},
+		{"team/**/prod", "team/project/env/prod", true},
+		{"team/**/prod", "team/prod", true},
+		{"team/**/prod", "team/project/dev", false},
+		{"team-?/prod", "team-a/prod", true},
+		{"my_state", "my_state", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.tfID, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchStatePattern(tt.pattern, tt.tfID))
+		})
+	}
+}
+
+func TestACLPolicy_allowed(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "acl.yaml", testACLPolicy)
+	policy, _ := loadACLPolicy(tmpTestDir + "acl.yaml")
+
+	tests := []struct {
+		name       string
+		identity   Identity
+		tfID       string
+		permission Permission
+		want       bool
+	}{
+		{"auditor reads", Identity{Name: "carol"}, "team-a/project/env", PermissionRead, true},
+		{"auditor writes", Identity{Name: "carol"}, "team-a/project/env", PermissionWrite, false},
+		{"group of identity", Identity{Name: "dave", Groups: []string{"auditors"}}, "team-b/project", PermissionRead, true},
+		{"owner writes", Identity{Name: "alice"}, "team-a/project/env.tfstate", PermissionWrite, true},
+		{"owner deletes", Identity{Name: "alice"}, "team-a/project/env", PermissionDelete, false},
+		{"other team", Identity{Name: "alice"}, "team-b/project/prod", PermissionRead, false},
+		{"admin deletes", Identity{Name: "bob"}, "team-b/project/prod", PermissionDelete, true},
+		{"admin outside path", Identity{Name: "bob"}, "team-b/project/dev", PermissionRead, false},
+		{"unknown user", Identity{Name: "mallory"}, "team-a/project/env", PermissionRead, false},
+		{"reader reads outputs", Identity{Name: "carol"}, "team-a/project/env", PermissionReadOutputs, true},
+		{"consumer reads outputs", Identity{Name: "erin"}, "team-a/project/env", PermissionReadOutputs, true},
+		{"consumer reads state", Identity{Name: "erin"}, "team-a/project/env", PermissionRead, false},
+		{"reader reads redacted", Identity{Name: "carol"}, "team-a/project/env", PermissionReadRedacted, true},
+		{"restricted reads redacted", Identity{Name: "frank"}, "team-a/project/env", PermissionReadRedacted, true},
+		{"restricted reads state", Identity{Name: "frank"}, "team-a/project/env", PermissionRead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.allowed(&tt.identity, tt.tfID, tt.permission))
+		})
+	}
+}
+
+func Test_authorize(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "acl.yaml", testACLPolicy)
+	stored := `{"version": 4, "terraform_version": "1.5.7", "serial": 1, "lineage": "a1", "outputs": {"vpc_id": {"value": "vpc-1", "type": "string"}}, "resources": []}`
+	createDirectoryFile(tmpTestDir, "team-a/project", "env.tfstate", stored)
+	policy, _ := loadACLPolicy(tmpTestDir + "acl.yaml")
+	state := testTfstate(2, "a1")
+	defer func() {
+		accessPolicy = nil
+	}()
+
+	tests := []struct {
+		name       string
+		policy     *ACLPolicy
+		username   string
+		method     string
+		suburl     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"without policy", nil, "", "GET", "/team-a/project/env", 200, stored},
+		{"anonymous", policy, "", "GET", "/team-a/project/env", 403, "Forbidden: user anonymous has no read permission on state team-a/project/env"},
+		{"auditor reads", policy, "carol", "GET", "/team-a/project/env", 200, stored},
+		{"auditor reads outputs", policy, "carol", "GET", "/team-a/project/env/outputs", 200, `{"vpc_id":{"value":"vpc-1","type":"string"}}`},
+		{"consumer reads outputs", policy, "erin", "GET", "/team-a/project/env/outputs/vpc_id", 200, `{"value":"vpc-1","type":"string"}`},
+		{"consumer reads state", policy, "erin", "GET", "/team-a/project/env", 200, `{"lineage":"a1","outputs":{"vpc_id":{"value":"vpc-1","type":"string"}},"resources":[],"serial":1,"terraform_version":"1.5.7","version":4}`},
+		{"consumer reads versions", policy, "erin", "GET", "/team-a/project/env/versions", 403, "Forbidden: user erin has no read permission on state team-a/project/env"},
+		{"auditor reads versions", policy, "carol", "GET", "/team-a/project/env/versions", 200, "[]"},
+		{"auditor writes", policy, "carol", "POST", "/team-a/project/env", 403, "Forbidden: user carol has no write permission on state team-a/project/env"},
+		{"auditor locks", policy, "carol", "LOCK", "/team-a/project/env", 403, "Forbidden: user carol has no lock permission on state team-a/project/env"},
+		{"auditor deletes", policy, "carol", "DELETE", "/team-a/project/env", 403, "Forbidden: user carol has no delete permission on state team-a/project/env"},
+		{"auditor rolls back", policy, "carol", "POST", "/team-a/project/env/rollback", 403, "Forbidden: user carol has no write permission on state team-a/project/env"},
+		{"owner writes", policy, "alice", "POST", "/team-a/project/env", 200, state},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			accessPolicy = tt.policy
+			chi.RegisterMethod("LOCK")
+			chi.RegisterMethod("UNLOCK")
+			router := chi.NewRouter()
+			if tt.username != "" {
+				router.Use(authenticate("restricted access", newStaticAuthenticator(map[string]string{"alice": "secret", "carol": "secret", "erin": "secret"})))
+			}
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, tt.method, tt.suburl, strings.NewReader(state), tt.username, "secret")
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	hooks.Reset()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// adminRouter returns the routes of the admin api. They are protected with
+// the admin credentials which are separate from the credentials of the states.
+func adminRouter(c *Config) http.Handler {
+	r := chi.NewRouter()
+	r.Use(authenticate("admin access", newStaticAuthenticator(c.getAdminAuthMap())))
+
+	r.Get("/locks", listLocks)
+	r.Delete("/locks/*", forceUnlockTfstate)
+	if apiTokens != nil {
+		r.Get("/tokens", listTokens)
+		r.Post("/tokens", createTokenHandler)
+		r.Delete("/tokens/{tokenID}", revokeTokenHandler)
+	}
+
+	return r
+}
+
+func listLocks(w http.ResponseWriter, _ *http.Request) {
+	locks, err := storageBackend.locks()
+	if err != nil {
+		logger.Warnf("Can't list locks. Got follow error %v", err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if locks == nil {
+		locks = []HeldLock{}
+	}
+	body, _ := json.Marshal(locks)
+	_, _ = w.Write(body)
+}
+
+func forceUnlockTfstate(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitStatePath(r, chi.URLParam(r, "*"))
+	if err == nil {
+		err = validateStateID(strings.Join(segments, "/"))
+	}
+	if err != nil {
+		logger.Infof("Refused force unlock. %v", err)
+		writeStatus(w, http.StatusBadRequest)
+		return
+	}
+	tfID := strings.Join(segments, "/")
+	lockInfo, err := releaseLock(storageBackend, tfID)
+	if err != nil {
+		logger.Warnf("Can't release lock of state %s. Got follow error %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if lockInfo == nil {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+	who := requestUser(r)
+	audit("lock_force_released", who, logrus.Fields{"state": tfID, "lock_id": lockInfo.ID, "lock_who": lockInfo.Who, "lock_created": lockInfo.Created},
+		"lock %s of state %s held by %s force released by %s", lockInfo.ID, tfID, lockInfo.Who, who)
+	body, _ := json.Marshal(lockInfo)
+	_, _ = w.Write(body)
+}
+
+func listTokens(w http.ResponseWriter, _ *http.Request) {
+	body, _ := json.Marshal(apiTokens.list())
+	_, _ = w.Write(body)
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var request TokenRequest
+
+	reqBody, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(reqBody, &request); err != nil {
+		writeStatus(w, http.StatusBadRequest)
+		return
+	}
+	token, secret, err := createToken(apiTokens, request, requestUser(r))
+	if err != nil {
+		logger.Infof("Can't create token. Got follow error %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusBadRequest) + ": " + err.Error()))
+		return
+	}
+	token.Hash = ""
+	body, _ := json.Marshal(CreatedToken{APIToken: token, Token: secret})
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(body)
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var notExists *TokenNotExistsError
+
+	token, err := revokeToken(apiTokens, chi.URLParam(r, "tokenID"), requestUser(r))
+	if err != nil {
+		if errors.As(err, &notExists) {
+			writeStatus(w, http.StatusNotFound)
+			return
+		}
+		logger.Warnf("Can't revoke token. Got follow error %v", err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	token.Hash = ""
+	body, _ := json.Marshal(token)
+	_, _ = w.Write(body)
+}
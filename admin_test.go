@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_listLocks(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfo := LockInfo{ID: "myid1", Operation: "OperationTypeApply", Who: "alice@host", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+	locksBytes, _ := json.Marshal([]HeldLock{{StateID: "locked_state", LockInfo: lockInfo}})
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfoBytes))
+	createFile(tmpTestDir, "locked_state.tfstate", "{}")
+	emptyTestDir, emptyCleanup := createDirectory()
+	defer emptyCleanup()
+
+	type args struct {
+		dir      string
+		username string
+		password string
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantStatus   int
+		wantBody     string
+		wantFailures float64
+	}{
+		{"without credentials", args{tmpTestDir, "", ""}, 401, "Unauthorized", 1},
+		{"with state credentials", args{tmpTestDir, "admin", "admin"}, 401, "Unauthorized", 1},
+		{"unknown user", args{tmpTestDir, "alice", "secret"}, 401, "Unauthorized", 1},
+		{"held locks", args{tmpTestDir, "admin", "secret"}, 200, string(locksBytes), 0},
+		{"no locks", args{emptyTestDir, "admin", "secret"}, 200, "[]", 0},
+		{"missing storage directory", args{emptyTestDir + "missing", "admin", "secret"}, 200, "[]", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetMetrics()
+			storageBackend = &Backend{dir: tt.args.dir}
+			ts := httptest.NewServer(adminRouter(&Config{adminUsername: "admin", adminPassword: "secret"}))
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, "GET", "/locks", nil, tt.args.username, tt.args.password)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+			assert.Equal(t, tt.wantFailures, authFailures.with([]string{"unauthenticated"}).value)
+			if tt.wantStatus == 401 {
+				assert.Equal(t, `Basic realm="admin access"`, rr.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_forceUnlockTfstate(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfo := LockInfo{ID: "myid1", Who: "alice@host", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfoBytes))
+	createDirectoryFile(tmpTestDir, "team/project", "env.lock", string(lockInfoBytes))
+
+	tests := []struct {
+		name       string
+		suburl     string
+		wantStatus int
+		wantBody   string
+		wantLogs   []string
+	}{
+		{"force unlock", "locked_state", 200, string(lockInfoBytes), []string{"lock myid1 of state locked_state held by alice@host force released by admin"}},
+		{"already unlocked", "locked_state", 404, "Not Found", nil},
+		{"force unlock nested state", "team/project/env", 200, string(lockInfoBytes), []string{"lock myid1 of state team/project/env held by alice@host force released by admin"}},
+		{"invalid state id", "team/%2e%2e/env", 400, "Bad Request", nil},
+		{"never locked", "unlocked_state", 404, "Not Found", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			ts := httptest.NewServer(adminRouter(&Config{adminUsername: "admin", adminPassword: "secret"}))
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, "DELETE", "/locks/"+tt.suburl, nil, "admin", "secret")
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+			checkLogMessage(t, tt.wantLogs)
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_adminTokens(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	var created CreatedToken
+	var listed []APIToken
+
+	apiTokens, _ = newTokenStore(tmpTestDir + "tokens.json")
+	defer func() {
+		apiTokens = nil
+	}()
+	ts := httptest.NewServer(adminRouter(&Config{adminUsername: "admin", adminPassword: "secret"}))
+	defer ts.Close()
+
+	rr, got := testAuthRequest(t, ts, "POST", "/tokens", strings.NewReader("no json"), "admin", "secret")
+	assert.Equal(t, 400, rr.StatusCode)
+	assert.Equal(t, "Bad Request", got)
+
+	rr, got = testAuthRequest(t, ts, "POST", "/tokens", strings.NewReader(`{"name": "ci", "user": "alice"}`), "admin", "secret")
+	assert.Equal(t, 400, rr.StatusCode)
+	assert.Equal(t, "Bad Request: token needs at least one scope", got)
+
+	rr, got = testAuthRequest(t, ts, "POST", "/tokens", strings.NewReader(
+		`{"name": "ci", "user": "alice", "scopes": [{"paths": ["team-a/**"], "permissions": ["read"]}], "expires_in": "24h"}`,
+	), "admin", "secret")
+	assert.Equal(t, 201, rr.StatusCode)
+	assert.Nil(t, json.Unmarshal([]byte(got), &created))
+	assert.True(t, strings.HasPrefix(created.Token, tokenPrefix+created.ID+"_"))
+	assert.Equal(t, "", created.Hash)
+	assert.NotContains(t, got, `"hash"`)
+	checkLogMessage(t, []string{"token " + created.ID + " (ci) of user alice created by admin"})
+
+	rr, got = testAuthRequest(t, ts, "GET", "/tokens", nil, "admin", "secret")
+	assert.Equal(t, 200, rr.StatusCode)
+	assert.Nil(t, json.Unmarshal([]byte(got), &listed))
+	assert.Equal(t, []APIToken{created.APIToken}, listed)
+	assert.NotContains(t, got, created.Token)
+
+	rr, _ = testAuthRequest(t, ts, "DELETE", "/tokens/"+created.ID, nil, "admin", "secret")
+	assert.Equal(t, 200, rr.StatusCode)
+	checkLogMessage(t, []string{"token " + created.ID + " (ci) of user alice revoked by admin"})
+	rr, got = testAuthRequest(t, ts, "DELETE", "/tokens/"+created.ID, nil, "admin", "secret")
+	assert.Equal(t, 404, rr.StatusCode)
+	assert.Equal(t, "Not Found", got)
+	hooks.Reset()
+}
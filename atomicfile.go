@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// tempFile is the part of an *os.File used by writeFileAtomic
+type tempFile interface {
+	Name() string
+	Write(p []byte) (int, error)
+	Sync() error
+	Close() error
+}
+
+// createTempFile creates the temporary file of writeFileAtomic, tests replace it to simulate failing writes
+var createTempFile = func(dir string, pattern string) (tempFile, error) {
+	return ioutil.TempFile(dir, pattern)
+}
+
+// writeFileAtomic replaces the file with the content, so a crash or a full disk never leaves a
+// partly written file. The content is written to a temporary file in the same directory, which
+// is synced to disk and renamed to the filename. The directory is synced to persist the rename.
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	var dir = filepath.Dir(filename)
+
+	// the dot prefix keeps the temporary file out of the state ids
+	tmpFile, err := createTempFile(dir, "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if _, err := tmpFile.Write(content); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return err
+	}
+	committed = true
+
+	return syncDirectory(dir)
+}
+
+// syncDirectory persists the entries of the directory, which is not supported on windows
+func syncDirectory(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+
+	return d.Sync()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingFile simulates a full disk by writing only a part of the content or failing to sync
+type failingFile struct {
+	*os.File
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errors.New("no space left on device")
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errors.New("input/output error")
+	}
+	return f.File.Sync()
+}
+
+// simulateFailingWrites lets writeFileAtomic fail until the returned function is called
+func simulateFailingWrites(failWrite bool, failSync bool) func() {
+	original := createTempFile
+	createTempFile = func(dir string, pattern string) (tempFile, error) {
+		file, err := ioutil.TempFile(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &failingFile{File: file, failWrite: failWrite, failSync: failSync}, nil
+	}
+	return func() {
+		createTempFile = original
+	}
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	tests := []struct {
+		name      string
+		failWrite bool
+		failSync  bool
+		wantErr   bool
+		want      string
+	}{
+		{"partial write", true, false, true, "old content"},
+		{"failing sync", false, true, true, "old content"},
+		{"write", false, false, false, "new content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createFile(tmpTestDir, "state.tfstate", "old content")
+			restore := simulateFailingWrites(tt.failWrite, tt.failSync)
+			defer restore()
+
+			err := writeFileAtomic(tmpTestDir+"state.tfstate", []byte("new content"), 0640)
+			assert.Equal(t, tt.wantErr, err != nil)
+			content, _ := ioutil.ReadFile(tmpTestDir + "state.tfstate")
+			assert.Equal(t, tt.want, string(content))
+			// the temporary file is removed in any case
+			entries, _ := ioutil.ReadDir(tmpTestDir)
+			assert.Len(t, entries, 1)
+			if !tt.wantErr {
+				assert.Equal(t, os.FileMode(0640), entries[0].Mode().Perm())
+			}
+		})
+	}
+
+	assert.Error(t, writeFileAtomic(tmpTestDir+"missing/state.tfstate", []byte("content"), 0644))
+}
+
+func TestBackend_updatePartialWrite(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	b := &Backend{dir: tmpTestDir}
+	assert.Nil(t, b.update("team/state", []byte(`{"serial": 1}`)))
+	_, err := b.lock("team/state", []byte(`{"ID": "1"}`))
+	assert.Nil(t, err)
+
+	restore := simulateFailingWrites(true, false)
+	assert.Error(t, b.update("team/state", []byte(`{"serial": 2}`)))
+	_, err = b.lock("team/other", []byte(`{"ID": "2"}`))
+	assert.Error(t, err)
+	restore()
+
+	state, _ := b.get("team/state")
+	assert.Equal(t, `{"serial": 1}`, string(state))
+	lockInfo, _ := b.getLock("team/state")
+	assert.Equal(t, "1", lockInfo.ID)
+	lockInfo, _ = b.getLock("team/other")
+	assert.Nil(t, lockInfo)
+	hooks.Reset()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+var auditLogger *logrus.Logger
+
+// SetupAuditLog writes the audit entries as json lines to the given file.
+// Without a file the audit entries are written to the default logger.
+func SetupAuditLog(filename string) error {
+	if filename == "" {
+		auditLogger = nil
+		return nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	auditLogger = logrus.New()
+	auditLogger.SetOutput(file)
+	auditLogger.SetFormatter(&logrus.JSONFormatter{})
+
+	return nil
+}
+
+// audit records an action changing a state like a rollback
+// together with the user who has done it
+func audit(event string, who string, fields logrus.Fields, format string, args ...interface{}) {
+	var l = auditLogger
+
+	if l == nil {
+		l = logger
+	}
+	l.WithFields(fields).WithField("event", event).WithField("who", who).Infof(format, args...)
+}
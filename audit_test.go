@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupAuditLog(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+	defer func() {
+		_ = SetupAuditLog("")
+	}()
+
+	auditFile := filepath.Join(tmpTestDir, "audit.log")
+	assert.Nil(t, SetupAuditLog(auditFile))
+	audit("rollback", "alice", logrus.Fields{"state": "my_state"}, "state %s rolled back", "my_state")
+
+	var entry map[string]interface{}
+	content, _ := os.ReadFile(auditFile)
+	assert.Nil(t, json.Unmarshal(content, &entry))
+	assert.Equal(t, "state my_state rolled back", entry["msg"])
+	assert.Equal(t, "rollback", entry["event"])
+	assert.Equal(t, "alice", entry["who"])
+	assert.Equal(t, "my_state", entry["state"])
+
+	assert.Error(t, SetupAuditLog(filepath.Join(tmpTestDir, "not_existing", "audit.log")))
+}
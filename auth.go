@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Identity is the authenticated user of a request
+type Identity struct {
+	Name string
+	// Method is the authentication method like "basic" or "htpasswd"
+	Method string
+	// Groups the user is member of as given by the authentication method
+	Groups []string
+	// Scopes limit the access of an api token, nil if the access is not limited
+	Scopes []TokenScope
+}
+
+// ErrInvalidCredentials is returned by an Authenticator if the credentials of a request are wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator verifies the credentials of a request. It returns nil without error if the
+// request carries no credentials it is responsible for, so the next authenticator is tried.
+type Authenticator interface {
+	authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// withIdentity returns a copy of the request carrying the authenticated identity
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// requestIdentity returns the authenticated identity of the request or nil
+func requestIdentity(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// requestBearer returns a token sent as bearer token or as password of basic auth,
+// so the terraform http backend client can send it without changes
+func requestBearer(r *http.Request) (string, bool) {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer "), true
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, true
+	}
+	return "", false
+}
+
+// authenticate is a middleware refusing requests which are not authenticated by one of the authenticators.
+// The identity of an authenticated request is available with requestIdentity.
+func authenticate(realm string, authenticators ...Authenticator) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticator := range authenticators {
+				identity, err := authenticator.authenticate(r)
+				if err != nil {
+					logger.Infof("Authentication failed for %s. %v", r.RemoteAddr, err)
+					break
+				}
+				if identity != nil {
+					next.ServeHTTP(w, withIdentity(r, identity))
+					return
+				}
+			}
+			authFailures.inc("unauthenticated")
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+			writeStatus(w, http.StatusUnauthorized)
+		})
+	}
+}
+
+// staticAuthenticator verifies basic auth credentials against the configured users
+type staticAuthenticator struct {
+	users map[string]string
+}
+
+func newStaticAuthenticator(users map[string]string) *staticAuthenticator {
+	return &staticAuthenticator{users: users}
+}
+
+func (s *staticAuthenticator) authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	expected, exists := s.users[username]
+	// compare also for unknown users to not leak the existence of a user by the response time
+	if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 || !exists {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{Name: username, Method: "basic"}, nil
+}
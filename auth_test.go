@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_authenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantStatus int
+		wantBody   string
+	}{
+		{"without credentials", "", "", 401, "Unauthorized"},
+		{"wrong password", "alice", "wrong", 401, "Unauthorized"},
+		{"unknown user", "mallory", "secret", 401, "Unauthorized"},
+		{"valid credentials", "alice", "secret", 200, "alice basic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := chi.NewRouter()
+			router.Use(authenticate("restricted access", newStaticAuthenticator(map[string]string{"alice": "secret"})))
+			router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				identity := requestIdentity(r)
+				_, _ = w.Write([]byte(identity.Name + " " + identity.Method))
+			})
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, "GET", "/", nil, tt.username, tt.password)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+			if tt.wantStatus == 401 {
+				assert.Equal(t, `Basic realm="restricted access"`, rr.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_requestUser(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "anonymous@192.0.2.1:1234", requestUser(r))
+
+	r.SetBasicAuth("bob", "secret")
+	assert.Equal(t, "bob", requestUser(r))
+
+	r = withIdentity(r, &Identity{Name: "alice", Method: "htpasswd"})
+	assert.Equal(t, "alice", requestUser(r))
+}
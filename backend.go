@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -14,6 +15,16 @@ import (
 // ConflictError if there is a locking conflict
 type ConflictError struct {
 	StatusCode int
+	// LockInfo of the lock currently held on the state, nil if unknown
+	LockInfo *LockInfo
+}
+
+// newLockConflictError returns a ConflictError for a state locked with the given lock
+func newLockConflictError(current LockInfo) *ConflictError {
+	return &ConflictError{
+		StatusCode: http.StatusConflict,
+		LockInfo:   &current,
+	}
 }
 
 func (c *ConflictError) Error() string {
@@ -40,16 +51,63 @@ type LockInfo struct {
 	Path      string
 }
 
-// Backend struct to serve as backend for terraform http backend storage
+// Backend struct to serve as backend for terraform http backend storage.
+// It is the default "file" storage driver storing the states and locks
+// as files in the configured storage directory.
 type Backend struct {
-	dir string
+	dir       string
+	retention HistoryRetention
+	lockTTL   time.Duration
+}
+
+func init() {
+	RegisterStorageDriver("file", newFileBackend)
+}
+
+func newFileBackend(c *Config) (StateStore, error) {
+	return &Backend{dir: c.storageDirectory, retention: c.getHistoryRetention(), lockTTL: c.lockTTL}, nil
 }
 
+// A state id like "team/project/env" is stored in nested directories below the storage directory.
 func (b *Backend) getTfstateFilename(tfID string) string {
-	if strings.HasSuffix(tfID, ".tfstate") {
-		return filepath.Join(b.dir, tfID)
+	return filepath.Join(b.dir, filepath.FromSlash(normalizeStateID(tfID))+".tfstate")
+}
+
+func (b *Backend) getLockFilename(tfID string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(normalizeStateID(tfID))+".lock")
+}
+
+func (b *Backend) getVersionDirectory(tfID string) string {
+	return filepath.Join(b.dir, ".versions", filepath.FromSlash(normalizeStateID(tfID)))
+}
+
+// createParentDirectory creates the directories of a nested state id
+func createParentDirectory(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		logger.Warnf("Can't create directory %s. Got follow error %v", filepath.Dir(filename), err)
+		return err
+	}
+	return nil
+}
+
+// ping writes and removes a temporary file in the storage directory
+func (b *Backend) ping() error {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(b.dir, ".healthcheck*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write([]byte("ok"))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
 	}
-	return filepath.Join(b.dir, tfID+".tfstate")
+	if removeErr := os.Remove(tmpFile.Name()); err == nil {
+		err = removeErr
+	}
+
+	return err
 }
 
 func (b *Backend) get(tfID string) ([]byte, error) {
@@ -72,13 +130,112 @@ func (b *Backend) get(tfID string) ([]byte, error) {
 func (b *Backend) update(tfID string, tfstate []byte) error {
 	var tfstateFilename = b.getTfstateFilename(tfID)
 
-	if err := ioutil.WriteFile(tfstateFilename, tfstate, 0644); err != nil {
+	if err := b.archive(tfID, tfstate); err != nil {
+		return err
+	}
+	if err := createParentDirectory(tfstateFilename); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(tfstateFilename, tfstate, 0644); err != nil {
 		logger.Warnf("Can't write file %s. Got follow error %v", tfstateFilename, err)
 		return err
 	}
+	b.prune(tfID)
+
+	return nil
+}
+
+// archive keeps the current state as new version if it will be replaced by different content
+func (b *Backend) archive(tfID string, tfstate []byte) error {
+	var tfstateFilename = b.getTfstateFilename(tfID)
+	var versionDirectory = b.getVersionDirectory(tfID)
+
+	current, err := ioutil.ReadFile(tfstateFilename)
+	if os.IsNotExist(err) || bytes.Equal(current, tfstate) {
+		return nil
+	}
+	if err != nil {
+		logger.Warnf("Can't read file %s. With follow error %v", tfstateFilename, err)
+		return err
+	}
+
+	versions, err := b.versions(tfID)
+	if err != nil {
+		return err
+	}
+	version := newStateVersion(versions, current, time.Now())
+	versionFilename := filepath.Join(versionDirectory, versionFileName(version))
+	if err := os.MkdirAll(versionDirectory, 0755); err != nil {
+		logger.Warnf("Can't create directory %s. Got follow error %v", versionDirectory, err)
+		return err
+	}
+	if err := writeFileAtomic(versionFilename, current, 0644); err != nil {
+		logger.Warnf("Can't write file %s. Got follow error %v", versionFilename, err)
+		return err
+	}
+
 	return nil
 }
 
+// prune removes the versions outside of the history retention
+func (b *Backend) prune(tfID string) {
+	var versionDirectory = b.getVersionDirectory(tfID)
+
+	versions, err := b.versions(tfID)
+	if err != nil {
+		return
+	}
+	for _, version := range b.retention.expired(versions, time.Now()) {
+		versionFilename := filepath.Join(versionDirectory, versionFileName(version))
+		if err := os.Remove(versionFilename); err != nil {
+			logger.Warnf("Can't delete file %s. Got follow error %v", versionFilename, err)
+		}
+	}
+}
+
+func (b *Backend) versions(tfID string) ([]StateVersion, error) {
+	var versionDirectory = b.getVersionDirectory(tfID)
+	var versions = []StateVersion{}
+
+	entries, err := ioutil.ReadDir(versionDirectory)
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err != nil {
+		logger.Warnf("Can't read directory %s. With follow error %v", versionDirectory, err)
+		return nil, err
+	}
+	for _, entry := range entries {
+		if version, ok := parseVersionFileName(entry.Name(), entry.Size()); ok {
+			versions = append(versions, version)
+		}
+	}
+	sortVersions(versions)
+
+	return versions, nil
+}
+
+func (b *Backend) getVersion(tfID string, version int) ([]byte, error) {
+	versions, err := b.versions(tfID)
+	if err != nil {
+		return nil, err
+	}
+	for _, stateVersion := range versions {
+		if stateVersion.Version == version {
+			versionFilename := filepath.Join(b.getVersionDirectory(tfID), versionFileName(stateVersion))
+			tfstate, err := ioutil.ReadFile(versionFilename)
+			if err != nil {
+				logger.Warnf("Can't read file %s. With follow error %v", versionFilename, err)
+				return nil, err
+			}
+			return tfstate, nil
+		}
+	}
+
+	logger.Infof("Version %d of state %s not found", version, tfID)
+	return nil, &VersionNotExistsError{TfID: tfID, Version: version}
+}
+
 func (b *Backend) purge(tfID string) error {
 	var log = GetLogger()
 	var tfstateFilename = b.getTfstateFilename(tfID)
@@ -95,8 +252,28 @@ func (b *Backend) purge(tfID string) error {
 	return nil
 }
 
+func (b *Backend) getLock(tfID string) (*LockInfo, error) {
+	var lockFilename = b.getLockFilename(tfID)
+	var lockInfo LockInfo
+
+	lockFile, err := ioutil.ReadFile(lockFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("Can't read file %s. With follow error %v", lockFilename, err)
+		return nil, err
+	}
+	if err := json.Unmarshal(lockFile, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	return &lockInfo, nil
+}
+
 func (b *Backend) lock(tfID string, lock []byte) ([]byte, error) {
-	var lockFilename string = b.dir + tfID + ".lock"
+	var lockFilename = b.getLockFilename(tfID)
 	var lockFile []byte
 	var lockInfo, currentLockInfo LockInfo
 	var err error
@@ -106,7 +283,10 @@ func (b *Backend) lock(tfID string, lock []byte) ([]byte, error) {
 		return nil, err
 	}
 	if _, err := os.Stat(lockFilename); os.IsNotExist(err) {
-		if err = ioutil.WriteFile(lockFilename, lock, 0644); err != nil {
+		if err := createParentDirectory(lockFilename); err != nil {
+			return nil, err
+		}
+		if err = writeFileAtomic(lockFilename, lock, 0644); err != nil {
 			logger.Errorf("Can't write lock file %s. Got follow error %v", lockFilename, err)
 			return nil, err
 		}
@@ -122,16 +302,120 @@ func (b *Backend) lock(tfID string, lock []byte) ([]byte, error) {
 		return nil, err
 	}
 	if currentLockInfo.ID != lockInfo.ID {
-		logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockInfo.ID, lockInfo.ID)
-		return nil, &ConflictError{
-			StatusCode: http.StatusConflict,
+		if !lockExpired(currentLockInfo, b.lockTTL, time.Now()) {
+			logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockInfo.ID, lockInfo.ID)
+			return nil, newLockConflictError(currentLockInfo)
+		}
+		if err = writeFileAtomic(lockFilename, lock, 0644); err != nil {
+			logger.Errorf("Can't write lock file %s. Got follow error %v", lockFilename, err)
+			return nil, err
+		}
+		auditReclaimedLock(tfID, currentLockInfo, lockInfo.Who)
+		return lock, nil
+	}
+	if b.lockTTL > 0 {
+		if lockFile, err = renewLock(lockFile, time.Now()); err != nil {
+			return nil, err
+		}
+		if err = writeFileAtomic(lockFilename, lockFile, 0644); err != nil {
+			logger.Errorf("Can't write lock file %s. Got follow error %v", lockFilename, err)
+			return nil, err
 		}
 	}
 	return lockFile, nil
 }
 
+func (b *Backend) locks() ([]HeldLock, error) {
+	var locks = []HeldLock{}
+
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the directory is created with the first state, without it there are no locks
+			if os.IsNotExist(err) && path == b.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() && info.Name() == ".versions" {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		lockFile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		held := HeldLock{}
+		if err := json.Unmarshal(lockFile, &held.LockInfo); err != nil {
+			logger.Warnf("Ignore lock file %s. Got follow error %v", path, err)
+			return nil
+		}
+		relativePath, _ := filepath.Rel(b.dir, path)
+		held.StateID = filepath.ToSlash(strings.TrimSuffix(relativePath, ".lock"))
+		locks = append(locks, held)
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Can't list locks in %s. Got follow error %v", b.dir, err)
+		return nil, err
+	}
+
+	return locks, nil
+}
+
+func (b *Backend) states() ([]string, error) {
+	var states = []string{}
+
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == b.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() && path != b.dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".tfstate") {
+			return nil
+		}
+		relativePath, _ := filepath.Rel(b.dir, path)
+		states = append(states, filepath.ToSlash(strings.TrimSuffix(relativePath, ".tfstate")))
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Can't list states in %s. Got follow error %v", b.dir, err)
+		return nil, err
+	}
+
+	return states, nil
+}
+
+func (b *Backend) removeLock(tfID string, lockInfo LockInfo) error {
+	var lockFilename = b.getLockFilename(tfID)
+
+	current, err := b.getLock(tfID)
+	if err != nil || current == nil {
+		return err
+	}
+	if !sameLock(*current, lockInfo) {
+		logger.Infof("lock file %s changed while removing the lock", lockFilename)
+		return newLockConflictError(*current)
+	}
+	if err := os.Remove(lockFilename); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("Can't delete file %s. Got follow error %v", lockFilename, err)
+		return err
+	}
+
+	return nil
+}
+
 func (b *Backend) unlock(tfID string, lock []byte) error {
-	var lockFilename string = b.dir + tfID + ".lock"
+	var lockFilename = b.getLockFilename(tfID)
 	var lockFile []byte
 	var err error
 	var lockInfo, currentLockInfo LockInfo
@@ -154,9 +438,7 @@ func (b *Backend) unlock(tfID string, lock []byte) error {
 	}
 	if currentLockInfo.ID != lockInfo.ID {
 		logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockInfo.ID, lockInfo.ID)
-		return &ConflictError{
-			StatusCode: http.StatusConflict,
-		}
+		return newLockConflictError(currentLockInfo)
 	}
 	if err := os.Remove(lockFilename); err != nil {
 		logger.Warnf("Can't delete file %s. Got follow error %v", lockFilename, err)
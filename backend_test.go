@@ -334,3 +334,112 @@ func TestFileNotExistsError_Error(t *testing.T) {
 		})
 	}
 }
+
+func TestBackend_versions(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	checkStateStoreVersions(t, &Backend{dir: tmpTestDir, retention: HistoryRetention{maxVersions: 2}})
+}
+
+func TestBackend_getLock(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfo1 := LockInfo{"myid1", "START", "ThisInfo", "", "", time.Now().UTC(), ""}
+	lockInfo1Bytes, _ := json.Marshal(lockInfo1)
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfo1Bytes))
+	createFile(tmpTestDir, "defect_state.lock", "no json")
+
+	tests := []struct {
+		name    string
+		tfID    string
+		want    *LockInfo
+		wantErr bool
+	}{
+		{"locked state", "locked_state", &lockInfo1, false},
+		{"locked state with extension", "locked_state.tfstate", &lockInfo1, false},
+		{"unlocked state", "unlocked_state", nil, false},
+		{"defect lock", "defect_state", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Backend{dir: tmpTestDir}
+			got, err := b.getLock(tt.tfID)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	hooks.Reset()
+}
+
+func TestBackend_lockExpiry(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createDirectoryFile(tmpTestDir, ".versions/ignored", "state.lock", "{}")
+	checkStateStoreLockExpiry(t, &Backend{dir: tmpTestDir, lockTTL: time.Hour})
+}
+
+func TestBackend_nestedState(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfo := LockInfo{ID: "myid1", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+	b := &Backend{dir: tmpTestDir}
+
+	assert.Nil(t, b.update("team/project/env", []byte("the content")))
+	assert.FileExists(t, filepath.Join(tmpTestDir, "team", "project", "env.tfstate"))
+	got, err := b.get("team/project/env.tfstate")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("the content"), got)
+
+	_, err = b.lock("team/project/other", lockInfoBytes)
+	assert.Nil(t, err)
+	locks, err := b.locks()
+	assert.Nil(t, err)
+	assert.Equal(t, []HeldLock{{StateID: "team/project/other", LockInfo: lockInfo}}, locks)
+
+	assert.Nil(t, b.purge("team/project/env"))
+	assert.NoFileExists(t, filepath.Join(tmpTestDir, "team", "project", "env.tfstate"))
+	hooks.Reset()
+}
+
+func TestBackend_ping(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	b := &Backend{dir: tmpTestDir + "store"}
+	assert.Nil(t, b.ping())
+	files, _ := os.ReadDir(tmpTestDir + "store")
+	assert.Empty(t, files)
+
+	createFile(tmpTestDir, "file", "not a directory")
+	b = &Backend{dir: tmpTestDir + "file"}
+	assert.Error(t, b.ping())
+}
+
+func TestBackend_states(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	checkStateStoreStates(t, &Backend{dir: tmpTestDir})
+	states, err := (&Backend{dir: tmpTestDir + "missing"}).states()
+	assert.Nil(t, err)
+	assert.Empty(t, states)
+}
+
+func TestBackend_locks(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	locks, err := (&Backend{dir: tmpTestDir + "missing"}).locks()
+	assert.Nil(t, err)
+	assert.Equal(t, []HeldLock{}, locks)
+	hooks.Reset()
+}
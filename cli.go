@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: terraform_http_backend [command]
+
+Without a command the http server is started.
+
+Commands:
+  rollback [-lock-id id] [-who name] <state path> <version>
+        restore a kept version as the current state
+  token create -user name -path pattern [-path pattern] [-permission list] [-expires duration] <token name>
+        create an api token, the token is only shown once
+  token list
+        list the api tokens
+  token revoke <token id>
+        revoke an api token
+`
+
+// runCommand runs the command line command given in args and returns the exit code
+func runCommand(args []string, out io.Writer) int {
+	switch args[0] {
+	case "rollback":
+		return rollbackCommand(args[1:], out)
+	case "token":
+		return tokenCommand(args[1:], out)
+	case "help", "-h", "--help":
+		_, _ = fmt.Fprint(out, usage)
+		return 0
+	default:
+		_, _ = fmt.Fprintf(out, "unknown command %s\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+func rollbackCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	flags.SetOutput(out)
+	lockID := flags.String("lock-id", "", "id of the lock held on the state")
+	who := flags.String("who", currentUser(), "name recorded as user who has done the rollback")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		_, _ = fmt.Fprint(out, usage)
+		return 2
+	}
+	tfID := flags.Arg(0)
+	if err := validateStateID(tfID); err != nil {
+		_, _ = fmt.Fprintf(out, "%v\n", err)
+		return 2
+	}
+	version, err := strconv.Atoi(flags.Arg(1))
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "invalid version %s\n", flags.Arg(1))
+		return 2
+	}
+
+	store, err := newStateStore(&config)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "can't initialize storage driver %s: %v\n", config.storageDriver, err)
+		return 1
+	}
+	if _, err := rollbackState(store, tfID, version, *lockID, config.lockStrict, config.lockTTL, *who); err != nil {
+		_, _ = fmt.Fprintf(out, "rollback of state %s to version %d failed: %v\n", tfID, version, err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "state %s rolled back to version %d\n", tfID, version)
+
+	return 0
+}
+
+// stringList is a flag which can be given multiple times
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func tokenCommand(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		_, _ = fmt.Fprint(out, usage)
+		return 2
+	}
+	if config.tokenFile == "" {
+		_, _ = fmt.Fprintln(out, "no token file configured, set TF_TOKEN_FILE")
+		return 1
+	}
+	store, err := newTokenStore(config.tokenFile)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "can't load token file %s: %v\n", config.tokenFile, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		return tokenCreateCommand(store, args[1:], out)
+	case "list":
+		for _, token := range store.list() {
+			expires := "never"
+			if !token.Expires.IsZero() {
+				expires = token.Expires.Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(out, "%s\t%s\t%s\texpires %s\n", token.ID, token.Name, token.User, expires)
+		}
+		return 0
+	case "revoke":
+		if len(args) != 2 {
+			_, _ = fmt.Fprint(out, usage)
+			return 2
+		}
+		if _, err := revokeToken(store, args[1], currentUser()); err != nil {
+			_, _ = fmt.Fprintf(out, "revoke of token %s failed: %v\n", args[1], err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(out, "token %s revoked\n", args[1])
+		return 0
+	default:
+		_, _ = fmt.Fprintf(out, "unknown token command %s\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+func tokenCreateCommand(store *TokenStore, args []string, out io.Writer) int {
+	var paths stringList
+	var permissions []Permission
+
+	flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+	flags.SetOutput(out)
+	username := flags.String("user", "", "user the token belongs to")
+	flags.Var(&paths, "path", "pattern of the state paths the token can access, can be given multiple times")
+	permissionList := flags.String("permission", "read", "comma separated permissions of the token")
+	expires := flags.Duration("expires", 0, "duration after which the token expires like 720h, 0 never expires")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		_, _ = fmt.Fprint(out, usage)
+		return 2
+	}
+	for _, permission := range strings.Split(*permissionList, ",") {
+		permissions = append(permissions, Permission(strings.TrimSpace(permission)))
+	}
+
+	request := TokenRequest{
+		Name:      flags.Arg(0),
+		User:      *username,
+		Scopes:    []TokenScope{{Paths: paths, Permissions: permissions}},
+		ExpiresIn: Duration{*expires},
+	}
+	token, secret, err := createToken(store, request, currentUser())
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "creation of token %s failed: %v\n", request.Name, err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "token %s created for user %s\n%s\n", token.ID, token.User, secret)
+
+	return 0
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
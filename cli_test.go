@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_runCommand(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	store := &Backend{dir: tmpTestDir}
+	_ = store.update("cli_state", []byte(`{"serial": 1}`))
+	_ = store.update("cli_state", []byte(`{"serial": 2}`))
+
+	currentConfig := config
+	defer func() {
+		config = currentConfig
+	}()
+	config.storageDriver = "file"
+	config.storageDirectory = tmpTestDir
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{"help", []string{"help"}, 0, usage},
+		{"unknown command", []string{"unknown"}, 2, "unknown command unknown\n\n" + usage},
+		{"rollback missing arguments", []string{"rollback", "cli_state"}, 2, usage},
+		{"rollback invalid state id", []string{"rollback", "../cli_state", "1"}, 2, "invalid state id \"../cli_state\": relative path segment\n"},
+		{"rollback invalid version", []string{"rollback", "cli_state", "latest"}, 2, "invalid version latest\n"},
+		{"rollback unknown version", []string{"rollback", "cli_state", "5"}, 1, "rollback of state cli_state to version 5 failed: version 5 of state cli_state not found\n"},
+		{"rollback", []string{"rollback", "-who", "bob", "cli_state", "1"}, 0, "state cli_state rolled back to version 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			got := runCommand(tt.args, &out)
+			assert.Equal(t, tt.wantCode, got)
+			assert.Equal(t, tt.wantOut, out.String())
+		})
+	}
+	current, _ := store.get("cli_state")
+	assert.Equal(t, []byte(`{"serial": 1}`), current)
+	assert.Equal(t, "bob", hooks.LastEntry().Data["who"])
+	hooks.Reset()
+}
+
+func Test_tokenCommand(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	currentConfig := config
+	defer func() {
+		config = currentConfig
+	}()
+	config.tokenFile = ""
+
+	var out bytes.Buffer
+	assert.Equal(t, 1, runCommand([]string{"token", "list"}, &out))
+	assert.Equal(t, "no token file configured, set TF_TOKEN_FILE\n", out.String())
+
+	config.tokenFile = tmpTestDir + "tokens.json"
+	out.Reset()
+	assert.Equal(t, 1, runCommand([]string{"token", "create", "-path", "team-a/**", "ci"}, &out))
+	assert.Equal(t, "creation of token ci failed: token needs a user\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 0, runCommand([]string{"token", "create", "-user", "alice", "-path", "team-a/**", "-permission", "read,write,lock", "-expires", "24h", "ci"}, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[1], tokenPrefix))
+
+	store, _ := newTokenStore(config.tokenFile)
+	tokens := store.list()
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, "token "+tokens[0].ID+" created for user alice", lines[0])
+		assert.Equal(t, []TokenScope{{Paths: []string{"team-a/**"}, Permissions: []Permission{PermissionRead, PermissionWrite, PermissionLock}}}, tokens[0].Scopes)
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), tokens[0].Expires, time.Minute)
+
+		out.Reset()
+		assert.Equal(t, 0, runCommand([]string{"token", "list"}, &out))
+		assert.Equal(t, tokens[0].ID+"\tci\talice\texpires "+tokens[0].Expires.Format(time.RFC3339)+"\n", out.String())
+
+		out.Reset()
+		assert.Equal(t, 0, runCommand([]string{"token", "revoke", tokens[0].ID}, &out))
+		assert.Equal(t, "token "+tokens[0].ID+" revoked\n", out.String())
+	}
+
+	out.Reset()
+	assert.Equal(t, 1, runCommand([]string{"token", "revoke", "unknown"}, &out))
+	assert.Equal(t, "revoke of token unknown failed: token unknown not found\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 2, runCommand([]string{"token", "rotate"}, &out))
+	assert.Equal(t, "unknown token command rotate\n\n"+usage, out.String())
+	hooks.Reset()
+}
@@ -1,17 +1,59 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // Config used to load configuration
 type Config struct {
+	storageDriver    string
 	storageDirectory string
+	sqlitePath       string
+	postgresDSN      string
+	s3Endpoint       string
+	s3Bucket         string
+	s3Prefix         string
+	s3Region         string
+	s3AccessKey      string
+	s3SecretKey      string
+	s3PathStyle      bool
+	historyVersions  int
+	historyMaxAge    time.Duration
+	auditLog         string
+	lockStrict       bool
+	lockTTL          time.Duration
+	lockReapInterval time.Duration
 	authEnabled      bool
 	username         string
 	password         string
+	htpasswdFile     string
+	aclFile          string
+	tokenFile        string
+	jwtJWKS          string
+	jwtJWKSRefresh   time.Duration
+	jwtIssuer        string
+	jwtAudience      string
+	jwtUserClaim     string
+	jwtGroupsClaim   string
+	jwtPathTemplates []string
+	jwtPermissions   []string
+	adminUsername    string
+	adminPassword    string
+	tlsCert          string
+	tlsKey           string
+	tlsClientCA      string
+	tlsClientAuth    string
+	maxBodySize      int64
+	redactAttributes []string
+	shutdownTimeout  time.Duration
+	metricsEnabled   bool
+	metricsAddr      string
 	port             int
 	ip               string
 }
@@ -21,10 +63,48 @@ func (c *Config) loadConfig(envfile string) {
 	viper.SetConfigType("env")
 	viper.AutomaticEnv()
 
+	viper.SetDefault("tf_storage_driver", "file")
 	viper.SetDefault("tf_storage_dir", "./store")
+	viper.SetDefault("tf_sqlite_path", "./store/terraform.db")
+	viper.SetDefault("tf_postgres_dsn", "")
+	viper.SetDefault("tf_s3_endpoint", "https://s3.amazonaws.com")
+	viper.SetDefault("tf_s3_bucket", "")
+	viper.SetDefault("tf_s3_prefix", "")
+	viper.SetDefault("tf_s3_region", "us-east-1")
+	viper.SetDefault("tf_s3_access_key", "")
+	viper.SetDefault("tf_s3_secret_key", "")
+	viper.SetDefault("tf_s3_path_style", true)
+	viper.SetDefault("tf_history_versions", 10)
+	viper.SetDefault("tf_history_max_age", "0s")
+	viper.SetDefault("tf_audit_log", "")
+	viper.SetDefault("tf_lock_strict", false)
+	viper.SetDefault("tf_lock_ttl", "0s")
+	viper.SetDefault("tf_lock_reap_interval", "1m")
 	viper.SetDefault("tf_auth_enabled", false)
 	viper.SetDefault("tf_username", "admin")
 	viper.SetDefault("tf_password", "admin")
+	viper.SetDefault("tf_htpasswd_file", "")
+	viper.SetDefault("tf_acl_file", "")
+	viper.SetDefault("tf_token_file", "")
+	viper.SetDefault("tf_jwt_jwks", "")
+	viper.SetDefault("tf_jwt_jwks_refresh", "1h")
+	viper.SetDefault("tf_jwt_issuer", "")
+	viper.SetDefault("tf_jwt_audience", "")
+	viper.SetDefault("tf_jwt_user_claim", "sub")
+	viper.SetDefault("tf_jwt_groups_claim", "groups")
+	viper.SetDefault("tf_jwt_paths", "")
+	viper.SetDefault("tf_jwt_permissions", "read,write,lock")
+	viper.SetDefault("tf_admin_username", "admin")
+	viper.SetDefault("tf_admin_password", "")
+	viper.SetDefault("tf_tls_cert", "")
+	viper.SetDefault("tf_tls_key", "")
+	viper.SetDefault("tf_tls_client_ca", "")
+	viper.SetDefault("tf_tls_client_auth", "require")
+	viper.SetDefault("tf_max_body_size", "100MB")
+	viper.SetDefault("tf_redact_attributes", "*password*,*secret*,*token*,private_key*")
+	viper.SetDefault("tf_shutdown_timeout", "30s")
+	viper.SetDefault("tf_metrics_enabled", false)
+	viper.SetDefault("tf_metrics_addr", "")
 	viper.SetDefault("tf_port", 8080)
 	viper.SetDefault("tf_ip", "127.0.0.1")
 
@@ -37,10 +117,48 @@ func (c *Config) loadConfig(envfile string) {
 		logger.Debugf("Error while reading config file %s", err)
 	}
 
+	c.storageDriver = viper.GetString("tf_storage_driver")
 	c.storageDirectory = viper.GetString("tf_storage_dir")
+	c.sqlitePath = viper.GetString("tf_sqlite_path")
+	c.postgresDSN = viper.GetString("tf_postgres_dsn")
+	c.s3Endpoint = viper.GetString("tf_s3_endpoint")
+	c.s3Bucket = viper.GetString("tf_s3_bucket")
+	c.s3Prefix = viper.GetString("tf_s3_prefix")
+	c.s3Region = viper.GetString("tf_s3_region")
+	c.s3AccessKey = viper.GetString("tf_s3_access_key")
+	c.s3SecretKey = viper.GetString("tf_s3_secret_key")
+	c.s3PathStyle = viper.GetBool("tf_s3_path_style")
+	c.historyVersions = viper.GetInt("tf_history_versions")
+	c.historyMaxAge = viper.GetDuration("tf_history_max_age")
+	c.auditLog = viper.GetString("tf_audit_log")
+	c.lockStrict = viper.GetBool("tf_lock_strict")
+	c.lockTTL = viper.GetDuration("tf_lock_ttl")
+	c.lockReapInterval = viper.GetDuration("tf_lock_reap_interval")
 	c.authEnabled = viper.GetBool("tf_auth_enabled")
 	c.username = viper.GetString("tf_username")
 	c.password = viper.GetString("tf_password")
+	c.htpasswdFile = viper.GetString("tf_htpasswd_file")
+	c.aclFile = viper.GetString("tf_acl_file")
+	c.tokenFile = viper.GetString("tf_token_file")
+	c.jwtJWKS = viper.GetString("tf_jwt_jwks")
+	c.jwtJWKSRefresh = viper.GetDuration("tf_jwt_jwks_refresh")
+	c.jwtIssuer = viper.GetString("tf_jwt_issuer")
+	c.jwtAudience = viper.GetString("tf_jwt_audience")
+	c.jwtUserClaim = viper.GetString("tf_jwt_user_claim")
+	c.jwtGroupsClaim = viper.GetString("tf_jwt_groups_claim")
+	c.jwtPathTemplates = splitList(viper.GetString("tf_jwt_paths"))
+	c.jwtPermissions = splitList(viper.GetString("tf_jwt_permissions"))
+	c.adminUsername = viper.GetString("tf_admin_username")
+	c.adminPassword = viper.GetString("tf_admin_password")
+	c.tlsCert = viper.GetString("tf_tls_cert")
+	c.tlsKey = viper.GetString("tf_tls_key")
+	c.tlsClientCA = viper.GetString("tf_tls_client_ca")
+	c.tlsClientAuth = viper.GetString("tf_tls_client_auth")
+	c.maxBodySize = int64(viper.GetSizeInBytes("tf_max_body_size"))
+	c.redactAttributes = splitList(viper.GetString("tf_redact_attributes"))
+	c.shutdownTimeout = viper.GetDuration("tf_shutdown_timeout")
+	c.metricsEnabled = viper.GetBool("tf_metrics_enabled")
+	c.metricsAddr = viper.GetString("tf_metrics_addr")
 	c.port = viper.GetInt("tf_port")
 	c.ip = viper.GetString("tf_ip")
 }
@@ -53,6 +171,90 @@ func (c *Config) getAuthMap() map[string]string {
 	return authData
 }
 
+// getAuthenticators returns the authenticators of the state requests. With a htpasswd
+// file its users are used instead of the configured username and password. With a jwks
+// jwts are verified before the passwords, so a jwt can be sent as password. With a client
+// ca a verified client certificate is used before all other credentials.
+func (c *Config) getAuthenticators() ([]Authenticator, error) {
+	var authenticators []Authenticator
+
+	if c.tlsClientCA != "" {
+		authenticators = append(authenticators, clientCertAuthenticator{})
+	}
+	if c.jwtJWKS != "" {
+		jwt, err := newJWTAuthenticator(c)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	if c.htpasswdFile == "" {
+		return append(authenticators, newStaticAuthenticator(c.getAuthMap())), nil
+	}
+	htpasswd, err := newHtpasswdAuthenticator(c.htpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(authenticators, htpasswd), nil
+}
+
+func (c *Config) getAdminAuthMap() map[string]string {
+	authData := make(map[string]string)
+
+	authData[c.adminUsername] = c.adminPassword
+
+	return authData
+}
+
 func (c *Config) getAddr() string {
 	return fmt.Sprintf("%s:%d", c.ip, c.port)
 }
+
+// getTLSConfig returns the tls configuration of the server, nil if no certificate is configured
+func (c *Config) getTLSConfig() (*tls.Config, error) {
+	if c.tlsCert == "" && c.tlsKey == "" && c.tlsClientCA == "" {
+		return nil, nil
+	}
+	if c.tlsCert == "" || c.tlsKey == "" {
+		return nil, errors.New("tls needs a certificate and a key")
+	}
+	certificates, err := newCertificateReloader(c.tlsCert, c.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certificates.getCertificate}
+	if c.tlsClientCA == "" {
+		return tlsConfig, nil
+	}
+	if tlsConfig.ClientCAs, err = loadCertPool(c.tlsClientCA); err != nil {
+		return nil, err
+	}
+	switch c.tlsClientAuth {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown tls client auth %q", c.tlsClientAuth)
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *Config) getHistoryRetention() HistoryRetention {
+	return HistoryRetention{maxVersions: c.historyVersions, maxAge: c.historyMaxAge}
+}
+
+// splitList splits a comma separated list and ignores empty items
+func splitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
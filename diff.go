@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Actions of a change between two states
+const (
+	actionAdded   = "added"
+	actionRemoved = "removed"
+	actionChanged = "changed"
+)
+
+// AttributeChange is a changed top level attribute of a resource instance.
+// Before is empty for an added attribute and after for a removed attribute.
+type AttributeChange struct {
+	Name   string          `json:"name"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// InstanceChange is an added, removed or changed resource instance like "aws_instance.web[0]"
+type InstanceChange struct {
+	Address    string            `json:"address"`
+	Action     string            `json:"action"`
+	Attributes []AttributeChange `json:"attributes,omitempty"`
+}
+
+// OutputChange is an added, removed or changed output of the root module
+type OutputChange struct {
+	Name   string          `json:"name"`
+	Action string          `json:"action"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// StateDiff are the changes between two versions of a state. A to version of 0 is the current state.
+type StateDiff struct {
+	From      int              `json:"from"`
+	To        int              `json:"to"`
+	Resources []InstanceChange `json:"resources"`
+	Outputs   []OutputChange   `json:"outputs"`
+}
+
+// stateInstances returns the attributes of the resource instances of a state of version 4 or 3
+// by the instance address like "module.vpc.aws_subnet.private[\"a\"]"
+func stateInstances(tfstate []byte) (map[string]map[string]json.RawMessage, error) {
+	var state struct {
+		Version   int `json:"version"`
+		Resources []struct {
+			Module    string `json:"module"`
+			Mode      string `json:"mode"`
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Instances []struct {
+				IndexKey   json.RawMessage            `json:"index_key"`
+				Attributes map[string]json.RawMessage `json:"attributes"`
+			} `json:"instances"`
+		} `json:"resources"`
+		Modules []struct {
+			Path      []string `json:"path"`
+			Resources map[string]struct {
+				Primary struct {
+					Attributes map[string]string `json:"attributes"`
+				} `json:"primary"`
+			} `json:"resources"`
+		} `json:"modules"`
+	}
+	var instances = make(map[string]map[string]json.RawMessage)
+
+	if err := json.Unmarshal(tfstate, &state); err != nil {
+		return nil, fmt.Errorf("can't parse state: %w", err)
+	}
+	switch state.Version {
+	case 4:
+		for _, r := range state.Resources {
+			resource := newStateResource(r.Module, r.Mode, r.Type, r.Name, "", 0)
+			for _, instance := range r.Instances {
+				address := resource.Address
+				if len(instance.IndexKey) > 0 {
+					address += "[" + string(instance.IndexKey) + "]"
+				}
+				instances[address] = instance.Attributes
+			}
+		}
+	case 3:
+		// a version 3 state has a resource per instance with keys like "aws_instance.web.0"
+		// and the attributes flattened to strings
+		for _, module := range state.Modules {
+			for key, r := range module.Resources {
+				resource, index, ok := parseLegacyResourceKey(legacyModuleAddress(module.Path), key)
+				if !ok {
+					continue
+				}
+				address := resource.Address
+				if index != "" {
+					address += "[" + index + "]"
+				}
+				attributes := make(map[string]json.RawMessage)
+				for name, value := range r.Primary.Attributes {
+					attributes[name], _ = json.Marshal(value)
+				}
+				instances[address] = attributes
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+
+	return instances, nil
+}
+
+// diffStates compares the resource instances and outputs of two states
+func diffStates(from []byte, to []byte) (StateDiff, error) {
+	var diff = StateDiff{Resources: []InstanceChange{}, Outputs: []OutputChange{}}
+
+	fromInstances, err := stateInstances(from)
+	if err != nil {
+		return diff, err
+	}
+	toInstances, err := stateInstances(to)
+	if err != nil {
+		return diff, err
+	}
+	fromOutputs, err := stateOutputs(from)
+	if err != nil {
+		return diff, err
+	}
+	toOutputs, err := stateOutputs(to)
+	if err != nil {
+		return diff, err
+	}
+
+	var addresses = make(map[string]bool)
+	for address := range fromInstances {
+		addresses[address] = true
+	}
+	for address := range toInstances {
+		addresses[address] = true
+	}
+	for _, address := range sortedKeys(addresses) {
+		before, inFrom := fromInstances[address]
+		after, inTo := toInstances[address]
+		switch {
+		case !inFrom:
+			diff.Resources = append(diff.Resources, InstanceChange{Address: address, Action: actionAdded})
+		case !inTo:
+			diff.Resources = append(diff.Resources, InstanceChange{Address: address, Action: actionRemoved})
+		default:
+			if changes := diffAttributes(before, after); len(changes) > 0 {
+				diff.Resources = append(diff.Resources, InstanceChange{Address: address, Action: actionChanged, Attributes: changes})
+			}
+		}
+	}
+
+	var names = make(map[string]bool)
+	for name := range fromOutputs {
+		names[name] = true
+	}
+	for name := range toOutputs {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		before, inFrom := fromOutputs[name]
+		after, inTo := toOutputs[name]
+		switch {
+		case !inFrom:
+			diff.Outputs = append(diff.Outputs, OutputChange{Name: name, Action: actionAdded, After: after.Value})
+		case !inTo:
+			diff.Outputs = append(diff.Outputs, OutputChange{Name: name, Action: actionRemoved, Before: before.Value})
+		case !equalJSON(before.Value, after.Value):
+			diff.Outputs = append(diff.Outputs, OutputChange{Name: name, Action: actionChanged, Before: before.Value, After: after.Value})
+		}
+	}
+
+	return diff, nil
+}
+
+// diffAttributes returns the changed top level attributes of a resource instance
+func diffAttributes(before map[string]json.RawMessage, after map[string]json.RawMessage) []AttributeChange {
+	var changes []AttributeChange
+	var names = make(map[string]bool)
+
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		if !equalJSON(before[name], after[name]) {
+			changes = append(changes, AttributeChange{Name: name, Before: before[name], After: after[name]})
+		}
+	}
+
+	return changes
+}
+
+// equalJSON compares two json values ignoring the formatting
+func equalJSON(a json.RawMessage, b json.RawMessage) bool {
+	var compactA, compactB bytes.Buffer
+
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// versionName returns the name of a version in the text format of a diff
+func versionName(version int) string {
+	if version == 0 {
+		return "current state"
+	}
+	return fmt.Sprintf("version %d", version)
+}
+
+// writeText writes the diff in a human readable format similar to a terraform plan
+func (d StateDiff) writeText(w io.Writer) {
+	symbols := map[string]string{actionAdded: "+", actionRemoved: "-", actionChanged: "~"}
+
+	_, _ = fmt.Fprintf(w, "Changes from %s to %s:\n", versionName(d.From), versionName(d.To))
+	if len(d.Resources) == 0 && len(d.Outputs) == 0 {
+		_, _ = fmt.Fprintln(w, "No changes.")
+		return
+	}
+	for _, change := range d.Resources {
+		_, _ = fmt.Fprintf(w, "%s %s\n", symbols[change.Action], change.Address)
+		for _, attribute := range change.Attributes {
+			switch {
+			case attribute.Before == nil:
+				_, _ = fmt.Fprintf(w, "    + %s: %s\n", attribute.Name, attribute.After)
+			case attribute.After == nil:
+				_, _ = fmt.Fprintf(w, "    - %s: %s\n", attribute.Name, attribute.Before)
+			default:
+				_, _ = fmt.Fprintf(w, "    ~ %s: %s -> %s\n", attribute.Name, attribute.Before, attribute.After)
+			}
+		}
+	}
+	for _, change := range d.Outputs {
+		switch change.Action {
+		case actionAdded:
+			_, _ = fmt.Fprintf(w, "+ output.%s: %s\n", change.Name, change.After)
+		case actionRemoved:
+			_, _ = fmt.Fprintf(w, "- output.%s: %s\n", change.Name, change.Before)
+		default:
+			_, _ = fmt.Fprintf(w, "~ output.%s: %s -> %s\n", change.Name, change.Before, change.After)
+		}
+	}
+}
+
+// readStateVersion returns the kept version of a state or the current state for version 0
+func readStateVersion(store StateStore, tfID string, version int) ([]byte, error) {
+	if version > 0 {
+		return store.getVersion(tfID, version)
+	}
+	current, err := currentState(store, tfID)
+	if err == nil && current == nil {
+		return nil, &FileNotExistsError{Info: fmt.Sprintf("state %s not found", tfID)}
+	}
+
+	return current, err
+}
+
+// parseDiffVersion parses a version of the diff query, an empty to version is the current state
+func parseDiffVersion(value string, optional bool) (int, bool) {
+	if value == "" {
+		return 0, optional
+	}
+	version, err := strconv.Atoi(value)
+
+	return version, err == nil && version > 0
+}
+
+func getTfstateDiff(w http.ResponseWriter, r *http.Request) {
+	var notExists *FileNotExistsError
+	var versionNotExists *VersionNotExistsError
+
+	tfID := chi.URLParam(r, "id")
+	from, fromOK := parseDiffVersion(r.URL.Query().Get("from"), false)
+	to, toOK := parseDiffVersion(r.URL.Query().Get("to"), true)
+	if !fromOK || !toOK {
+		writeStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	var states [2][]byte
+	for i, version := range []int{from, to} {
+		state, err := readStateVersion(storageBackend, tfID, version)
+		if err != nil {
+			if errors.As(err, &notExists) || errors.As(err, &versionNotExists) {
+				writeStatus(w, http.StatusNotFound)
+				return
+			}
+			logger.Warnf("Can not read %s of state %s: %v", versionName(version), tfID, err)
+			writeStatus(w, http.StatusInternalServerError)
+			return
+		}
+		states[i] = state
+	}
+	diff, err := diffStates(states[0], states[1])
+	if err != nil {
+		logger.Warnf("Can not compare the versions of state %s: %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	diff.From, diff.To = from, to
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		diff.writeText(w)
+		return
+	}
+	body, _ := json.Marshal(diff)
+	_, _ = w.Write(body)
+}
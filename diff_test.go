@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDiffFromTfstate = `{"version": 4, "terraform_version": "1.5.7", "serial": 1, "lineage": "a1",
+  "outputs": {"ip": {"value": "10.0.0.1", "type": "string"}, "old": {"value": true, "type": "bool"}},
+  "resources": [
+    {"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+      {"index_key": 0, "attributes": {"id": "i-1", "instance_type": "t3.micro", "tags": {"env": "prod"}}}
+    ]},
+    {"mode": "managed", "type": "aws_s3_bucket", "name": "logs", "instances": [{"attributes": {"id": "logs"}}]}
+  ]}`
+
+const testDiffToTfstate = `{"version": 4, "terraform_version": "1.5.7", "serial": 2, "lineage": "a1",
+  "outputs": {"ip": {"value": "10.0.0.2", "type": "string"}, "new": {"value": 1, "type": "number"}},
+  "resources": [
+    {"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+      {"index_key": 0, "attributes": {"id": "i-1", "instance_type": "t3.large", "tags": {"env":"prod"}, "ebs_optimized": true}},
+      {"index_key": 1, "attributes": {"id": "i-2"}}
+    ]},
+    {"module": "module.dns", "mode": "managed", "type": "aws_route53_record", "name": "www", "instances": [{"index_key": "a", "attributes": {"id": "www"}}]}
+  ]}`
+
+func Test_diffStates(t *testing.T) {
+	diff, err := diffStates([]byte(testDiffFromTfstate), []byte(testDiffToTfstate))
+	assert.Nil(t, err)
+	assert.Equal(t, []InstanceChange{
+		{Address: "aws_instance.web[0]", Action: actionChanged, Attributes: []AttributeChange{
+			{Name: "ebs_optimized", After: json.RawMessage("true")},
+			{Name: "instance_type", Before: json.RawMessage(`"t3.micro"`), After: json.RawMessage(`"t3.large"`)},
+		}},
+		{Address: "aws_instance.web[1]", Action: actionAdded},
+		{Address: "aws_s3_bucket.logs", Action: actionRemoved},
+		{Address: `module.dns.aws_route53_record.www["a"]`, Action: actionAdded},
+	}, diff.Resources)
+	assert.Equal(t, []OutputChange{
+		{Name: "ip", Action: actionChanged, Before: json.RawMessage(`"10.0.0.1"`), After: json.RawMessage(`"10.0.0.2"`)},
+		{Name: "new", Action: actionAdded, After: json.RawMessage("1")},
+		{Name: "old", Action: actionRemoved, Before: json.RawMessage("true")},
+	}, diff.Outputs)
+
+	diff, err = diffStates([]byte(testDiffToTfstate), []byte(testDiffToTfstate))
+	assert.Nil(t, err)
+	assert.Empty(t, diff.Resources)
+	assert.Empty(t, diff.Outputs)
+
+	_, err = diffStates([]byte(testDiffFromTfstate), []byte(`{"version": 5}`))
+	assert.EqualError(t, err, "unsupported state version 5")
+}
+
+func Test_stateInstances(t *testing.T) {
+	instances, err := stateInstances([]byte(`{"version": 3, "serial": 1, "modules": [
+	  {"path": ["root"], "outputs": {}, "resources": {
+	    "aws_instance.web.0": {"type": "aws_instance", "primary": {"attributes": {"id": "i-1"}}},
+	    "data.aws_ami.ubuntu": {"type": "aws_ami", "primary": {"attributes": {"id": "ami-1"}}}
+	  }},
+	  {"path": ["root", "vpc"], "outputs": {}, "resources": {"aws_vpc.main": {"type": "aws_vpc", "primary": {"attributes": {"cidr_block": "10.0.0.0/16"}}}}}
+	]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string]json.RawMessage{
+		"aws_instance.web[0]":     {"id": json.RawMessage(`"i-1"`)},
+		"data.aws_ami.ubuntu":     {"id": json.RawMessage(`"ami-1"`)},
+		"module.vpc.aws_vpc.main": {"cidr_block": json.RawMessage(`"10.0.0.0/16"`)},
+	}, instances)
+}
+
+func TestStateDiff_writeText(t *testing.T) {
+	var b strings.Builder
+
+	diff, _ := diffStates([]byte(testDiffFromTfstate), []byte(testDiffToTfstate))
+	diff.From = 1
+	diff.writeText(&b)
+	assert.Equal(t, `Changes from version 1 to current state:
+~ aws_instance.web[0]
+    + ebs_optimized: true
+    ~ instance_type: "t3.micro" -> "t3.large"
++ aws_instance.web[1]
+- aws_s3_bucket.logs
++ module.dns.aws_route53_record.www["a"]
+~ output.ip: "10.0.0.1" -> "10.0.0.2"
++ output.new: 1
+- output.old: true
+`, b.String())
+
+	b.Reset()
+	StateDiff{From: 1, To: 2}.writeText(&b)
+	assert.Equal(t, "Changes from version 1 to version 2:\nNo changes.\n", b.String())
+}
+
+func Test_getTfstateDiff(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	b := &Backend{dir: tmpTestDir}
+	_ = b.update("team/web", []byte(testDiffFromTfstate))
+	_ = b.update("team/web", []byte(testDiffToTfstate))
+	// a formatting change keeps the to state as version 2
+	_ = b.update("team/web", []byte(strings.Replace(testDiffToTfstate, "\n", " ", 1)))
+
+	tests := []struct {
+		name       string
+		suburl     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"versions", "/team/web/diff?from=1&to=2", 200, `{"from":1,"to":2,"resources":[{"address":"aws_instance.web[0]","action":"changed","attributes":[{"name":"ebs_optimized","after":true},{"name":"instance_type","before":"t3.micro","after":"t3.large"}]},{"address":"aws_instance.web[1]","action":"added"},{"address":"aws_s3_bucket.logs","action":"removed"},{"address":"module.dns.aws_route53_record.www[\"a\"]","action":"added"}],"outputs":[{"name":"ip","action":"changed","before":"10.0.0.1","after":"10.0.0.2"},{"name":"new","action":"added","after":1},{"name":"old","action":"removed","before":true}]}`},
+		{"to current state", "/team/web/diff?from=2", 200, `{"from":2,"to":0,"resources":[],"outputs":[]}`},
+		{"text", "/team/web/diff?from=2&format=text", 200, "Changes from version 2 to current state:\nNo changes.\n"},
+		{"missing from", "/team/web/diff?to=2", 400, "Bad Request"},
+		{"invalid to", "/team/web/diff?from=1&to=latest", 400, "Bad Request"},
+		{"unknown version", "/team/web/diff?from=1&to=9", 404, "Not Found"},
+		{"unknown state", "/team/missing/diff?from=1", 404, "Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = b
+			router := chi.NewRouter()
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", tt.suburl, nil)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	hooks.Reset()
+}
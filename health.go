@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+)
+
+// reservedStatePaths are the top level paths of the server, which can't be used as state id
+var reservedStatePaths = map[string]bool{
+	"admin":     true,
+	"metrics":   true,
+	"healthz":   true,
+	"readyz":    true,
+	"resources": true,
+}
+
+// healthz answers as long as the process is able to serve requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("{\"status\": \"ok\"}"))
+}
+
+// readyz answers with 503 if the storage is not reachable or not writable
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if err := storageBackend.ping(); err != nil {
+		logger.Warnf("Storage is not ready. Got follow error %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("{\"status\": \"unavailable\"}"))
+		return
+	}
+	_, _ = w.Write([]byte("{\"status\": \"ok\"}"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_healthz(t *testing.T) {
+	router := chi.NewRouter()
+	router.Get("/healthz", healthz)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	rr, got := testRequest(t, ts, "GET", "/healthz", nil)
+
+	assert.Equal(t, 200, rr.StatusCode)
+	assert.Equal(t, `{"status": "ok"}`, got)
+}
+
+func Test_readyz(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "file", "not a directory")
+
+	tests := []struct {
+		name       string
+		dir        string
+		wantStatus int
+		wantBody   string
+	}{
+		{"writable directory", tmpTestDir + "store", 200, `{"status": "ok"}`},
+		{"not a directory", tmpTestDir + "file", 503, `{"status": "unavailable"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tt.dir}
+			router := chi.NewRouter()
+			router.Get("/readyz", readyz)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", "/readyz", nil)
+
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	hooks.Reset()
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,12 +29,25 @@ func createFile(directory string, filename string, content string) {
 	_ = os.WriteFile(directory+filename, []byte(content), 0644)
 }
 
+func createDirectoryFile(directory string, subdirectory string, filename string, content string) {
+	_ = os.MkdirAll(filepath.Join(directory, subdirectory), 0755)
+	_ = os.WriteFile(filepath.Join(directory, subdirectory, filename), []byte(content), 0644)
+}
+
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) (*http.Response, string) {
+	return testAuthRequest(t, ts, method, path, body, "", "")
+}
+
+// testAuthRequest sends the request with basic auth credentials if a username is given
+func testAuthRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader, username, password string) (*http.Response, string) {
 	req, err := http.NewRequest(method, ts.URL+path, body)
 	if err != nil {
 		t.Fatal(err)
 		return nil, ""
 	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -67,3 +86,116 @@ func checkLogMessage(t *testing.T, wantLogs []string) {
 	}
 	hooks.Reset()
 }
+
+// checkStateStoreVersions checks the version history of a store with a retention of 2 versions
+func checkStateStoreVersions(t *testing.T, store StateStore) {
+	var notExists *VersionNotExistsError
+	var stateID = fmt.Sprintf("history_state%d", time.Now().UnixNano())
+
+	versions, err := store.versions(stateID)
+	assert.Nil(t, err)
+	assert.Empty(t, versions)
+
+	for serial := 1; serial <= 4; serial++ {
+		assert.Nil(t, store.update(stateID, []byte(fmt.Sprintf(`{"serial": %d}`, serial))))
+	}
+	// same content creates no new version
+	assert.Nil(t, store.update(stateID, []byte(`{"serial": 4}`)))
+
+	versions, err = store.versions(stateID + ".tfstate")
+	assert.Nil(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, 2, versions[0].Version)
+		assert.Equal(t, int64(2), versions[0].Serial)
+		assert.Equal(t, 3, versions[1].Version)
+		assert.Equal(t, int64(3), versions[1].Serial)
+		assert.Equal(t, int64(13), versions[1].Size)
+	}
+
+	got, err := store.getVersion(stateID, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"serial": 3}`), got)
+
+	_, err = store.getVersion(stateID, 1)
+	assert.ErrorAs(t, err, &notExists)
+	checkLogMessage(t, []string{fmt.Sprintf("Version 1 of state %s not found", stateID)})
+}
+
+// checkStateStoreStates checks that the stored states are listed without their versions and locks
+func checkStateStoreStates(t *testing.T, store StateStore) {
+	var prefix = fmt.Sprintf("states%d", time.Now().UnixNano())
+	lock, _ := json.Marshal(LockInfo{ID: "1", Who: "alice", Created: time.Now().UTC()})
+
+	assert.Nil(t, store.update(prefix+"/team/env", []byte(testTfstate(1, "a1"))))
+	assert.Nil(t, store.update(prefix+"/team/env", []byte(testTfstate(2, "a1"))))
+	assert.Nil(t, store.update(prefix+"/other.tfstate", []byte(testTfstate(1, "b1"))))
+	_, err := store.lock(prefix+"/locked_only", lock)
+	assert.Nil(t, err)
+
+	states, err := store.states()
+	assert.Nil(t, err)
+	var got []string
+	for _, state := range states {
+		if strings.HasPrefix(state, prefix+"/") {
+			got = append(got, state)
+		}
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{prefix + "/other", prefix + "/team/env"}, got)
+	hooks.Reset()
+}
+
+// checkStateStoreLockExpiry checks the lock expiry of a store with a lock ttl of 1 hour
+func checkStateStoreLockExpiry(t *testing.T, store StateStore) {
+	var conflict *ConflictError
+	var stateID = fmt.Sprintf("expiry_state%d", time.Now().UnixNano())
+
+	expiredLock, _ := json.Marshal(LockInfo{ID: "expired", Who: "alice", Created: time.Now().Add(-2 * time.Hour).UTC()})
+	newLock, _ := json.Marshal(LockInfo{ID: "new", Who: "bob", Created: time.Now().Add(-30 * time.Minute).UTC()})
+	otherLock, _ := json.Marshal(LockInfo{ID: "other", Who: "carol", Created: time.Now().UTC()})
+
+	_, err := store.lock(stateID, expiredLock)
+	assert.Nil(t, err)
+	locks, err := store.locks()
+	assert.Nil(t, err)
+	assert.Contains(t, locks, HeldLock{StateID: stateID, LockInfo: mustLockInfo(expiredLock)})
+
+	got, err := store.lock(stateID, newLock)
+	assert.Nil(t, err)
+	assert.Equal(t, newLock, got)
+	entry := hooks.LastEntry()
+	assert.Equal(t, "lock_reclaimed", entry.Data["event"])
+	assert.Equal(t, "expired", entry.Data["lock_id"])
+	assert.Equal(t, "bob", entry.Data["who"])
+
+	// sending the own lock again renews it
+	got, err = store.lock(stateID, newLock)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), mustLockInfo(got).Created, time.Minute)
+
+	// the lock read before the renewal isn't removed
+	assert.ErrorAs(t, store.removeLock(stateID, mustLockInfo(newLock)), &conflict)
+	current, err := store.getLock(stateID)
+	assert.Nil(t, err)
+	assert.Equal(t, mustLockInfo(got), *current)
+
+	_, err = store.lock(stateID, otherLock)
+	assert.ErrorAs(t, err, &conflict)
+
+	assert.GreaterOrEqual(t, reapExpiredLocks(store, time.Nanosecond), 1)
+	current, err = store.getLock(stateID)
+	assert.Nil(t, err)
+	assert.Nil(t, current)
+	hooks.Reset()
+}
+
+func mustLockInfo(lock []byte) LockInfo {
+	var lockInfo LockInfo
+	_ = json.Unmarshal(lock, &lockInfo)
+	return lockInfo
+}
+
+// testTfstate returns a valid terraform state with the serial and lineage
+func testTfstate(serial int, lineage string) string {
+	return fmt.Sprintf(`{"version": 4, "terraform_version": "1.5.7", "serial": %d, "lineage": "%s", "outputs": {}, "resources": []}`, serial, lineage)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StateVersion describes a kept previous version of a state
+type StateVersion struct {
+	Version int       `json:"version"`
+	Serial  int64     `json:"serial"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// VersionNotExistsError is returned if the requested version of a state is not kept
+type VersionNotExistsError struct {
+	TfID    string
+	Version int
+}
+
+func (v *VersionNotExistsError) Error() string {
+	return fmt.Sprintf("version %d of state %s not found", v.Version, v.TfID)
+}
+
+// HistoryRetention defines how many and how old versions of a state are kept.
+// A zero value disables the limit.
+type HistoryRetention struct {
+	maxVersions int
+	maxAge      time.Duration
+}
+
+// expired returns the versions which are outside of the retention
+func (h HistoryRetention) expired(versions []StateVersion, now time.Time) []StateVersion {
+	var expired []StateVersion
+
+	sorted := make([]StateVersion, len(versions))
+	copy(sorted, versions)
+	sortVersions(sorted)
+
+	for i, version := range sorted {
+		tooMany := h.maxVersions > 0 && i < len(sorted)-h.maxVersions
+		tooOld := h.maxAge > 0 && now.Sub(version.Created) > h.maxAge
+		if tooMany || tooOld {
+			expired = append(expired, version)
+		}
+	}
+
+	return expired
+}
+
+// nextVersion returns the number of the version to create after the given versions
+func nextVersion(versions []StateVersion) int {
+	var last int
+
+	for _, version := range versions {
+		if version.Version > last {
+			last = version.Version
+		}
+	}
+
+	return last + 1
+}
+
+// newStateVersion creates the version information for the content of a state
+func newStateVersion(versions []StateVersion, tfstate []byte, created time.Time) StateVersion {
+	return StateVersion{
+		Version: nextVersion(versions),
+		Serial:  tfstateSerial(tfstate),
+		Created: created.UTC(),
+		Size:    int64(len(tfstate)),
+	}
+}
+
+func sortVersions(versions []StateVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+}
+
+// versionFileName encodes the version information in a file or object name
+// like "3-1637940915-42.tfstate" with version, creation time and serial
+func versionFileName(version StateVersion) string {
+	return fmt.Sprintf("%d-%d-%d.tfstate", version.Version, version.Created.Unix(), version.Serial)
+}
+
+// parseVersionFileName is the reverse of versionFileName
+func parseVersionFileName(name string, size int64) (StateVersion, bool) {
+	parts := strings.Split(strings.TrimSuffix(name, ".tfstate"), "-")
+	if len(parts) != 3 || !strings.HasSuffix(name, ".tfstate") {
+		return StateVersion{}, false
+	}
+	version, err1 := strconv.Atoi(parts[0])
+	created, err2 := strconv.ParseInt(parts[1], 10, 64)
+	serial, err3 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return StateVersion{}, false
+	}
+
+	return StateVersion{
+		Version: version,
+		Serial:  serial,
+		Created: time.Unix(created, 0).UTC(),
+		Size:    size,
+	}, true
+}
+
+// tfstateSerial returns the serial of a terraform state or 0 if the state can't be parsed
+func tfstateSerial(tfstate []byte) int64 {
+	var header struct {
+		Serial int64 `json:"serial"`
+	}
+
+	if err := json.Unmarshal(tfstate, &header); err != nil {
+		return 0
+	}
+
+	return header.Serial
+}
+
+// rollbackState restores a kept version as the current state. The rollback is refused
+// like an update if the state is locked with another lock id than the given one or, in
+// strict mode, if the state is not locked. The replaced state is kept as new version,
+// so a rollback can be reverted.
+func rollbackState(store StateStore, tfID string, version int, lockID string, strict bool, ttl time.Duration, who string) ([]byte, error) {
+	if err := checkLockOwnership(store, tfID, lockID, strict, ttl); err != nil {
+		return nil, err
+	}
+
+	tfstate, err := store.getVersion(tfID, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.update(tfID, tfstate); err != nil {
+		return nil, err
+	}
+	audit("rollback", who, logrus.Fields{"state": tfID, "version": version, "serial": tfstateSerial(tfstate)},
+		"state %s rolled back to version %d by %s", tfID, version, who)
+
+	return tfstate, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryRetention_expired(t *testing.T) {
+	now := time.Now()
+	versions := []StateVersion{
+		{Version: 3, Created: now.Add(-1 * time.Hour)},
+		{Version: 1, Created: now.Add(-3 * time.Hour)},
+		{Version: 2, Created: now.Add(-2 * time.Hour)},
+	}
+	tests := []struct {
+		name      string
+		retention HistoryRetention
+		want      []int
+	}{
+		{"no limits", HistoryRetention{}, nil},
+		{"max versions", HistoryRetention{maxVersions: 2}, []int{1}},
+		{"max age", HistoryRetention{maxAge: 90 * time.Minute}, []int{1, 2}},
+		{"max versions and age", HistoryRetention{maxVersions: 1, maxAge: 150 * time.Minute}, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, version := range tt.retention.expired(versions, now) {
+				got = append(got, version.Version)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_newStateVersion(t *testing.T) {
+	created := time.Date(2021, 11, 26, 15, 35, 15, 0, time.UTC)
+	versions := []StateVersion{{Version: 4}, {Version: 2}}
+
+	got := newStateVersion(versions, []byte(`{"version": 4, "serial": 42}`), created)
+	assert.Equal(t, StateVersion{Version: 5, Serial: 42, Created: created, Size: 28}, got)
+
+	got = newStateVersion(nil, []byte("no json"), created)
+	assert.Equal(t, StateVersion{Version: 1, Serial: 0, Created: created, Size: 7}, got)
+}
+
+func Test_versionFileName(t *testing.T) {
+	version := StateVersion{Version: 3, Serial: 42, Created: time.Unix(1637940915, 0).UTC(), Size: 12}
+
+	name := versionFileName(version)
+	assert.Equal(t, "3-1637940915-42.tfstate", name)
+
+	got, ok := parseVersionFileName(name, 12)
+	assert.True(t, ok)
+	assert.Equal(t, version, got)
+
+	for _, invalid := range []string{"3-1637940915.tfstate", "a-1637940915-42.tfstate", "3-1637940915-42.lock"} {
+		_, ok = parseVersionFileName(invalid, 0)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestVersionNotExistsError_Error(t *testing.T) {
+	err := &VersionNotExistsError{TfID: "my_state", Version: 3}
+	assert.Equal(t, "version 3 of state my_state not found", err.Error())
+}
+
+func Test_rollbackState(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfoBytes, _ := json.Marshal(LockInfo{ID: "myid1", Created: time.Now()})
+	store := &Backend{dir: tmpTestDir}
+	_ = store.update("rollback_state", []byte(`{"serial": 1}`))
+	_ = store.update("rollback_state", []byte(`{"serial": 2}`))
+
+	_, err := rollbackState(store, "rollback_state", 3, "", false, 0, "alice")
+	var notExists *VersionNotExistsError
+	assert.ErrorAs(t, err, &notExists)
+
+	var locked *LockedError
+	_, err = rollbackState(store, "rollback_state", 1, "", true, 0, "alice")
+	assert.ErrorAs(t, err, &locked)
+	assert.Nil(t, locked.LockInfo)
+	checkLogMessage(t, []string{"state rollback_state is not locked, but strict locking requires a lock"})
+
+	_, _ = store.lock("rollback_state", lockInfoBytes)
+	_, err = rollbackState(store, "rollback_state", 1, "otherid", false, 0, "alice")
+	assert.ErrorAs(t, err, &locked)
+	checkLogMessage(t, []string{"state is locked with diffrend id myid1, but follow id requestd change otherid"})
+
+	got, err := rollbackState(store, "rollback_state", 1, "myid1", true, time.Hour, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"serial": 1}`), got)
+	current, _ := store.get("rollback_state")
+	assert.Equal(t, []byte(`{"serial": 1}`), current)
+	entry := hooks.LastEntry()
+	assert.Equal(t, "state rollback_state rolled back to version 1 by alice", entry.Message)
+	assert.Equal(t, "rollback", entry.Data["event"])
+	assert.Equal(t, "alice", entry.Data["who"])
+
+	// the replaced state is kept, so the rollback can be reverted
+	versions, _ := store.versions("rollback_state")
+	assert.Len(t, versions, 2)
+	hooks.Reset()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2idMaxMemory limits the memory in KiB of an argon2id hash, the memory is allocated for every login
+const argon2idMaxMemory = 256 * 1024
+
+// dummyHash is compared for unknown users to not leak the existence of a user by the response time
+var dummyHash = []byte("$2a$10$O23zg3PVdy7VWnKidPuIeO2VUTxi0rH1xSyeitGdz9snoKEDAYqwK")
+
+// htpasswdAuthenticator verifies basic auth credentials against the users of a htpasswd file
+// with bcrypt or argon2id hashed passwords. The file is read again if it has been changed.
+type htpasswdAuthenticator struct {
+	path    string
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func newHtpasswdAuthenticator(path string) (*htpasswdAuthenticator, error) {
+	h := &htpasswdAuthenticator{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// load reads the users of the htpasswd file
+func (h *htpasswdAuthenticator) load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(content)
+	if err != nil {
+		return fmt.Errorf("can't parse htpasswd file %s: %w", h.path, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+
+	return nil
+}
+
+// reloadIfChanged reads the htpasswd file again if its modification time or size has changed.
+// On errors the users read before are kept.
+func (h *htpasswdAuthenticator) reloadIfChanged() {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		logger.Warnf("Can't read htpasswd file %s. Got follow error %v", h.path, err)
+		return
+	}
+	h.mu.RLock()
+	changed := !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+	h.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := h.load(); err != nil {
+		logger.Warnf("Can't reload htpasswd file %s. Got follow error %v", h.path, err)
+		return
+	}
+	logger.Infof("htpasswd file %s reloaded", h.path)
+}
+
+func (h *htpasswdAuthenticator) authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	h.reloadIfChanged()
+
+	h.mu.RLock()
+	hash, exists := h.users[username]
+	h.mu.RUnlock()
+	if !exists {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if !verifyPasswordHash(hash, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{Name: username, Method: "htpasswd"}, nil
+}
+
+// parseHtpasswd parses the lines "user:hash" of a htpasswd file. Empty lines and
+// lines starting with # are ignored. Only bcrypt and argon2id hashes are accepted.
+func parseHtpasswd(content []byte) (map[string]string, error) {
+	var users = make(map[string]string)
+	var scanner = bufio.NewScanner(bytes.NewReader(content))
+	var line int
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		if !supportedPasswordHash(parts[1]) {
+			return nil, fmt.Errorf("line %d: unsupported password hash of user %s, only bcrypt and argon2id are supported", line, parts[0])
+		}
+		if strings.HasPrefix(parts[1], "$argon2id$") {
+			if _, err := parseArgon2idHash(parts[1]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid argon2id hash of user %s: %w", line, parts[0], err)
+			}
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	return users, scanner.Err()
+}
+
+func supportedPasswordHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPasswordHash compares the password in constant time with a bcrypt or argon2id hash
+func verifyPasswordHash(hash string, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2idHash(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// argon2idHash are the parameters, salt and key of an argon2id hash
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// parseArgon2idHash parses a hash in the format "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>"
+// with the salt and key encoded as base64 without padding. Parameters argon2 can't compute
+// with or which would allocate too much memory on every login are refused.
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	var version int
+	var h argon2idHash
+	var err error
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("expected $argon2id$v=19$m=...,t=...,p=...$<salt>$<key>")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported version %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid parameters %s", parts[3])
+	}
+	switch {
+	case h.iterations < 1:
+		return nil, errors.New("t must be at least 1")
+	case h.parallelism < 1:
+		return nil, errors.New("p must be at least 1")
+	case h.memory < 8*uint32(h.parallelism):
+		return nil, errors.New("m must be at least 8 times p")
+	case h.memory > argon2idMaxMemory:
+		return nil, fmt.Errorf("m must be at most %d", argon2idMaxMemory)
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(h.key) < 16 {
+		return nil, errors.New("key must be at least 16 bytes long")
+	}
+
+	return &h, nil
+}
+
+// verifyArgon2idHash compares the password with an argon2id hash, see parseArgon2idHash for the format
+func verifyArgon2idHash(hash string, password string) bool {
+	h, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+
+	return subtle.ConstantTimeCompare(got, h.key) == 1
+}
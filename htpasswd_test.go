@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the password of both hashes is "secret"
+const (
+	testBcryptHash   = "$2a$10$y9HbxlglkRXtYFw.BCsQkOx8paeG7F6Dwm8Huzu3Q5ap9yfnXFktq"
+	testArgon2idHash = "$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj4ZK8FlD6rkQWTf1yOuw63QPe2qI"
+)
+
+func Test_parseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"users", "# comment\n\nalice:" + testBcryptHash + "\nbob:" + testArgon2idHash + "\n", map[string]string{"alice": testBcryptHash, "bob": testArgon2idHash}, false},
+		{"missing hash", "alice\n", nil, true},
+		{"missing user", ":" + testBcryptHash + "\n", nil, true},
+		{"plaintext password", "alice:secret\n", nil, true},
+		{"md5 hash", "alice:$apr1$salt$hash\n", nil, true},
+		{"argon2id without rounds", "alice:$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj4ZK8FlD6rkQWTf1yOuw63QPe2qI\n", nil, true},
+		{"argon2id without threads", "alice:$argon2id$v=19$m=65536,t=1,p=0$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj4ZK8FlD6rkQWTf1yOuw63QPe2qI\n", nil, true},
+		{"argon2id too much memory", "alice:$argon2id$v=19$m=4194304,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj4ZK8FlD6rkQWTf1yOuw63QPe2qI\n", nil, true},
+		{"argon2id empty key", "alice:$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$\n", nil, true},
+		{"argon2id short key", "alice:$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj\n", nil, true},
+		{"argon2id defect hash", "alice:$argon2id$v=19$m=65536$salt$key\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHtpasswd([]byte(tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_verifyPasswordHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"bcrypt", testBcryptHash, "secret", true},
+		{"bcrypt wrong password", testBcryptHash, "wrong", false},
+		{"argon2id", testArgon2idHash, "secret", true},
+		{"argon2id wrong password", testArgon2idHash, "wrong", false},
+		{"argon2id defect hash", "$argon2id$v=19$m=65536$salt$key", "secret", false},
+		{"argon2id without rounds", "$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj4ZK8FlD6rkQWTf1yOuw63QPe2qI", "secret", false},
+		{"argon2id empty key", "$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$", "secret", false},
+		{"argon2id other version", "$argon2id$v=16$m=65536,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$4uBDRbZea/aTRkPj4ZK8FlD6rkQWTf1yOuw63QPe2qI", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, verifyPasswordHash(tt.hash, tt.password))
+		})
+	}
+}
+
+func Test_htpasswdAuthenticator(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	_, err := newHtpasswdAuthenticator(tmpTestDir + "missing")
+	assert.Error(t, err)
+
+	createFile(tmpTestDir, "htpasswd", "alice:"+testBcryptHash+"\n")
+	h, err := newHtpasswdAuthenticator(tmpTestDir + "htpasswd")
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	identity, err := h.authenticate(r)
+	assert.Nil(t, err)
+	assert.Nil(t, identity)
+
+	r.SetBasicAuth("alice", "secret")
+	identity, err = h.authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, &Identity{Name: "alice", Method: "htpasswd"}, identity)
+
+	r.SetBasicAuth("alice", "wrong")
+	_, err = h.authenticate(r)
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	r.SetBasicAuth("bob", "secret")
+	_, err = h.authenticate(r)
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// a changed file is used without restart
+	createFile(tmpTestDir, "htpasswd", "bob:"+testArgon2idHash+"\n")
+	identity, err = h.authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, &Identity{Name: "bob", Method: "htpasswd"}, identity)
+	checkLogMessage(t, []string{"htpasswd file " + tmpTestDir + "htpasswd reloaded"})
+
+	// a defect file keeps the users read before
+	createFile(tmpTestDir, "htpasswd", "bob:secret\nalice:secret\n")
+	identity, err = h.authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", identity.Name)
+
+	_ = os.Remove(tmpTestDir + "htpasswd")
+	identity, err = h.authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", identity.Name)
+	hooks.Reset()
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hash functions of the signature algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway is the allowed clock skew for the time claims of a jwt
+const jwtLeeway = time.Minute
+
+// jwksMinRefresh limits the reload of the jwks for unknown key ids
+const jwksMinRefresh = time.Minute
+
+// jwksMaxBackoff limits the wait between the reloads of a jwks which failed to load
+const jwksMaxBackoff = 15 * time.Minute
+
+// jwtAlgorithms are the supported signature algorithms with their hash function
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtClaimPlaceholder matches a placeholder like "{project_path}" in a path template
+var jwtClaimPlaceholder = regexp.MustCompile(`\{([A-Za-z0-9_.-]+)\}`)
+
+// JWK is a public key of a json web key set
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the json web key to a rsa or ecdsa public key
+func (k JWK) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// jwksSource loads the keys of a json web key set from a file or url. The keys are loaded
+// again after the refresh interval or if a jwt is signed with an unknown key id. The wait
+// between two loads doubles with every failed load, so an unreachable jwks isn't requested
+// for every jwt.
+type jwksSource struct {
+	location  string
+	refresh   time.Duration
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	loaded    time.Time
+	attempted time.Time
+	failures  int
+}
+
+func newJWKSSource(location string, refresh time.Duration) (*jwksSource, error) {
+	j := &jwksSource{location: location, refresh: refresh, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *jwksSource) read() ([]byte, error) {
+	if !strings.HasPrefix(j.location, "https://") && !strings.HasPrefix(j.location, "http://") {
+		return ioutil.ReadFile(j.location)
+	}
+	resp, err := j.client.Get(j.location)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// load reads the key set and records the attempt, keys of unsupported types are skipped
+func (j *jwksSource) load() error {
+	keys, err := j.fetch()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.attempted = time.Now()
+	if err != nil {
+		j.failures++
+		return err
+	}
+	j.keys = keys
+	j.loaded = j.attempted
+	j.failures = 0
+
+	return nil
+}
+
+func (j *jwksSource) fetch() (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	content, err := j.read()
+	if err != nil {
+		return nil, fmt.Errorf("can't read jwks %s: %w", j.location, err)
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, fmt.Errorf("can't parse jwks %s: %w", j.location, err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.Warnf("Ignore key %s of jwks %s. Got follow error %v", jwk.Kid, j.location, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// retryWait returns the minimum time between two loads, which doubles with every failed load
+func (j *jwksSource) retryWait() time.Duration {
+	wait := jwksMinRefresh
+	for i := 0; i < j.failures && wait < jwksMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > jwksMaxBackoff {
+		return jwksMaxBackoff
+	}
+	return wait
+}
+
+// key returns the public key with the key id
+func (j *jwksSource) key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	now := time.Now()
+	stale := !ok || (j.refresh > 0 && now.Sub(j.loaded) > j.refresh)
+	reload := stale && now.Sub(j.attempted) > j.retryWait()
+	if reload {
+		// claim the attempt, so concurrent requests don't load the jwks as well
+		j.attempted = now
+	}
+	j.mu.Unlock()
+
+	if reload {
+		if err := j.load(); err != nil {
+			logger.Warnf("Can't reload jwks. %v", err)
+		}
+		j.mu.Lock()
+		key, ok = j.keys[kid]
+		j.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	return key, nil
+}
+
+// jwtAuthenticator verifies OIDC id tokens like issued by GitLab CI or GitHub Actions.
+// The jwt is accepted as bearer token or as password of basic auth.
+type jwtAuthenticator struct {
+	keys        *jwksSource
+	issuer      string
+	audience    string
+	userClaim   string
+	groupsClaim string
+	// pathTemplates like "gitlab/{project_path}/**" limit the access to the states, the
+	// placeholders are replaced with the claims of the jwt
+	pathTemplates []string
+	permissions   []Permission
+}
+
+func newJWTAuthenticator(c *Config) (*jwtAuthenticator, error) {
+	if c.jwtIssuer == "" {
+		return nil, errors.New("jwt authentication needs an issuer")
+	}
+	// without an acl every jwt of the issuer, like of any project on gitlab.com, would get
+	// access to all states
+	if c.aclFile == "" && (c.jwtAudience == "" || len(c.jwtPathTemplates) == 0) {
+		return nil, errors.New("jwt authentication without acl file needs an audience and path templates")
+	}
+	keys, err := newJWKSSource(c.jwtJWKS, c.jwtJWKSRefresh)
+	if err != nil {
+		return nil, err
+	}
+	j := &jwtAuthenticator{
+		keys:          keys,
+		issuer:        c.jwtIssuer,
+		audience:      c.jwtAudience,
+		userClaim:     c.jwtUserClaim,
+		groupsClaim:   c.jwtGroupsClaim,
+		pathTemplates: c.jwtPathTemplates,
+	}
+	for _, permission := range c.jwtPermissions {
+		j.permissions = append(j.permissions, Permission(permission))
+	}
+	if len(j.pathTemplates) > 0 {
+		if err := validateGrant(j.pathTemplates, j.permissions); err != nil {
+			return nil, fmt.Errorf("invalid jwt path templates: %w", err)
+		}
+	}
+
+	return j, nil
+}
+
+// looksLikeJWT reports if the value has the form of a signed jwt "header.payload.signature"
+func looksLikeJWT(value string) bool {
+	return strings.HasPrefix(value, "eyJ") && strings.Count(value, ".") == 2
+}
+
+func (j *jwtAuthenticator) authenticate(r *http.Request) (*Identity, error) {
+	value, ok := requestBearer(r)
+	if !ok || !looksLikeJWT(value) {
+		return nil, nil
+	}
+	claims, err := j.verify(value, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt: %w", err)
+	}
+
+	return j.identity(claims)
+}
+
+// verify checks the signature and the registered claims of the jwt and returns its claims
+func (j *jwtAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims map[string]interface{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, err := j.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := verifyJWTSignature(header.Alg, hash, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := j.verifyClaims(claims, now); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed []byte, signature []byte) error {
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s doesn't match the rsa key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("algorithm %s doesn't match the ecdsa key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key")
+	}
+
+	return nil
+}
+
+func (j *jwtAuthenticator) verifyClaims(claims map[string]interface{}, now time.Time) error {
+	if issuer, _ := claims["iss"].(string); issuer != j.issuer {
+		return fmt.Errorf("unexpected issuer %q", issuer)
+	}
+	if j.audience != "" && !jwtAudienceContains(claims["aud"], j.audience) {
+		return fmt.Errorf("audience %s missing", j.audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("expiry missing")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+func jwtAudienceContains(aud interface{}, audience string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identity maps the claims of a verified jwt to the identity of the request
+func (j *jwtAuthenticator) identity(claims map[string]interface{}) (*Identity, error) {
+	name, _ := claims[j.userClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("claim %s missing", j.userClaim)
+	}
+	identity := &Identity{Name: name, Method: "jwt"}
+	if groups, ok := claims[j.groupsClaim].([]interface{}); ok {
+		for _, group := range groups {
+			if group, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, group)
+			}
+		}
+	}
+	if len(j.pathTemplates) == 0 {
+		return identity, nil
+	}
+
+	scope := TokenScope{Permissions: j.permissions}
+	for _, template := range j.pathTemplates {
+		path, err := expandPathTemplate(template, claims)
+		if err != nil {
+			return nil, err
+		}
+		scope.Paths = append(scope.Paths, path)
+	}
+	identity.Scopes = []TokenScope{scope}
+
+	return identity, nil
+}
+
+// expandPathTemplate replaces the placeholders of the template with the claims. A claim
+// can't widen the pattern with wildcards or "..". Reserved names are allowed in a claim,
+// as it is placed below the prefix of the template and not at the root.
+func expandPathTemplate(template string, claims map[string]interface{}) (string, error) {
+	var err error
+
+	path := jwtClaimPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := strings.Trim(placeholder, "{}")
+		value, _ := claims[name].(string)
+		if value == "" {
+			err = fmt.Errorf("claim %s missing", name)
+			return ""
+		}
+		if strings.ContainsAny(value, "*?[]\\") || validateStatePathSegments(value) != nil {
+			err = fmt.Errorf("claim %s is not a valid state path", name)
+			return ""
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := validateStatePathSegments(path); err != nil {
+		return "", fmt.Errorf("expanded path %q is not valid: %w", path, err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testJWTKeys struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	jwks   []byte
+}
+
+func createTestJWTKeys(t *testing.T) testJWTKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(value *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(value.Bytes())
+	}
+	jwks, _ := json.Marshal(map[string][]JWK{"keys": {
+		{Kid: "rsa", Kty: "RSA", Use: "sig", N: encode(rsaKey.N), E: encode(big.NewInt(int64(rsaKey.E)))},
+		{Kid: "ec", Kty: "EC", Crv: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)},
+		{Kid: "oct", Kty: "oct"},
+	}})
+
+	return testJWTKeys{rsaKey: rsaKey, ecKey: ecKey, jwks: jwks}
+}
+
+// sign creates a jwt signed with the rsa key for RS256 and the ec key for ES256
+func (k testJWTKeys) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest.Sum(nil))
+	case "ES256":
+		r, s, signErr := ecdsa.Sign(rand.Reader, k.ecKey, digest.Sum(nil))
+		signature, err = append(padTo(r.Bytes(), 32), padTo(s.Bytes(), 32)...), signErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func padTo(value []byte, size int) []byte {
+	return append(make([]byte, size-len(value)), value...)
+}
+
+func testJWTClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":          "https://gitlab.example.com",
+		"aud":          "terraform",
+		"sub":          "project_path:group/project:ref_type:branch:ref:main",
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"project_path": "group/project",
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func Test_jwtAuthenticator(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	keys := createTestJWTKeys(t)
+	createFile(tmpTestDir, "jwks.json", string(keys.jwks))
+	j, err := newJWTAuthenticator(&Config{
+		jwtJWKS:          tmpTestDir + "jwks.json",
+		jwtIssuer:        "https://gitlab.example.com",
+		jwtAudience:      "terraform",
+		jwtUserClaim:     "sub",
+		jwtGroupsClaim:   "groups",
+		jwtPathTemplates: []string{"gitlab/{project_path}/**"},
+		jwtPermissions:   []string{"read", "write", "lock"},
+	})
+	assert.Nil(t, err)
+
+	wantScopes := []TokenScope{{Paths: []string{"gitlab/group/project/**"}, Permissions: []Permission{PermissionRead, PermissionWrite, PermissionLock}}}
+	tests := []struct {
+		name         string
+		token        string
+		basicAuth    bool
+		wantIdentity *Identity
+		wantErr      bool
+	}{
+		{"no jwt", "tfb_some_token", false, nil, false},
+		{"rs256 bearer", keys.sign(t, "RS256", "rsa", testJWTClaims(nil)), false, &Identity{Name: "project_path:group/project:ref_type:branch:ref:main", Method: "jwt", Scopes: wantScopes}, false},
+		{"es256 basic auth password", keys.sign(t, "ES256", "ec", testJWTClaims(nil)), true, &Identity{Name: "project_path:group/project:ref_type:branch:ref:main", Method: "jwt", Scopes: wantScopes}, false},
+		{"groups", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"groups": []string{"ci"}, "aud": []string{"other", "terraform"}})), false, &Identity{Name: "project_path:group/project:ref_type:branch:ref:main", Method: "jwt", Groups: []string{"ci"}, Scopes: wantScopes}, false},
+		{"wrong issuer", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"iss": "https://evil.example.com"})), false, nil, true},
+		{"wrong audience", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"aud": "other"})), false, nil, true},
+		{"expired", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), false, nil, true},
+		{"missing expiry", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"exp": nil})), false, nil, true},
+		{"not valid yet", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), false, nil, true},
+		{"unknown key", keys.sign(t, "RS256", "unknown", testJWTClaims(nil)), false, nil, true},
+		{"key of other type", keys.sign(t, "RS256", "ec", testJWTClaims(nil)), false, nil, true},
+		{"missing user claim", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"sub": nil})), false, nil, true},
+		{"missing path claim", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"project_path": nil})), false, nil, true},
+		{"wildcard in path claim", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"project_path": "*"})), false, nil, true},
+		{"traversal in path claim", keys.sign(t, "RS256", "rsa", testJWTClaims(map[string]interface{}{"project_path": "group/../other"})), false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.basicAuth {
+				r.SetBasicAuth("gitlab-ci-token", tt.token)
+			} else {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			identity, err := j.authenticate(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantIdentity, identity)
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_expandPathTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		claim    interface{}
+		want     string
+		wantErr  bool
+	}{
+		{"project path", "gitlab/{project_path}/**", "group/project", "gitlab/group/project/**", false},
+		{"reserved top level name", "gitlab/{project_path}/**", "metrics/app", "gitlab/metrics/app/**", false},
+		{"sub resource name", "gitlab/{project_path}/**", "group/diff", "gitlab/group/diff/**", false},
+		{"missing claim", "gitlab/{project_path}/**", nil, "", true},
+		{"claim of other type", "gitlab/{project_path}/**", 42, "", true},
+		{"wildcard", "gitlab/{project_path}/**", "group/*", "", true},
+		{"traversal", "gitlab/{project_path}/**", "group/../other", "", true},
+		{"absolute path", "gitlab/{project_path}/**", "/group", "", true},
+		{"empty segment", "gitlab/{project_path}/**", "group//project", "", true},
+		{"control character", "gitlab/{project_path}/**", "group/\nproject", "", true},
+		{"claim combined to hidden segment", "gitlab/.{project_path}/**", "group", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandPathTemplate(tt.template, map[string]interface{}{"project_path": tt.claim})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_jwtAuthenticator_verify(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	keys := createTestJWTKeys(t)
+	createFile(tmpTestDir, "jwks.json", string(keys.jwks))
+	j, _ := newJWTAuthenticator(&Config{jwtJWKS: tmpTestDir + "jwks.json", jwtIssuer: "https://gitlab.example.com", jwtUserClaim: "sub", aclFile: tmpTestDir + "acl.yaml"})
+	token := keys.sign(t, "RS256", "rsa", testJWTClaims(nil))
+	header := func(alg string) string {
+		value, _ := json.Marshal(map[string]string{"alg": alg, "kid": "rsa"})
+		return base64.RawURLEncoding.EncodeToString(value)
+	}
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://gitlab.example.com","sub":"admin","exp":9999999999}`)) + "." + parts[2]},
+		{"none algorithm", header("none") + "." + parts[1] + "."},
+		{"hmac algorithm", header("HS256") + "." + parts[1] + "." + parts[2]},
+		{"malformed", "eyJ.no.jwt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := j.verify(tt.token, time.Now())
+			assert.Error(t, err)
+		})
+	}
+
+	claims, err := j.verify(token, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "group/project", claims["project_path"])
+	// without path templates the access is only limited by the acl
+	identity, err := j.identity(claims)
+	assert.Nil(t, err)
+	assert.Nil(t, identity.Scopes)
+}
+
+func Test_newJWTAuthenticator(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	keys := createTestJWTKeys(t)
+	createFile(tmpTestDir, "jwks.json", string(keys.jwks))
+	issuer := "https://gitlab.example.com"
+	paths := []string{"gitlab/{project_path}/**"}
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"audience and paths", Config{jwtIssuer: issuer, jwtAudience: "terraform", jwtPathTemplates: paths}, false},
+		{"acl without audience and paths", Config{jwtIssuer: issuer, aclFile: tmpTestDir + "acl.yaml"}, false},
+		{"missing issuer", Config{jwtAudience: "terraform", jwtPathTemplates: paths}, true},
+		{"missing audience", Config{jwtIssuer: issuer, jwtPathTemplates: paths}, true},
+		{"missing paths", Config{jwtIssuer: issuer, jwtAudience: "terraform"}, true},
+		{"invalid path", Config{jwtIssuer: issuer, jwtAudience: "terraform", jwtPathTemplates: []string{"gitlab/[/**"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.jwtJWKS = tmpTestDir + "jwks.json"
+			_, err := newJWTAuthenticator(&tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func Test_jwksSource(t *testing.T) {
+	keys := createTestJWTKeys(t)
+	otherKeys := createTestJWTKeys(t)
+	current := keys.jwks
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if current == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write(current)
+	}))
+	defer ts.Close()
+
+	_, err := newJWKSSource("/not/existing/jwks.json", 0)
+	assert.Error(t, err)
+
+	source, err := newJWKSSource(ts.URL, 0)
+	assert.Nil(t, err)
+	key, err := source.key("rsa")
+	assert.Nil(t, err)
+	assert.Equal(t, &keys.rsaKey.PublicKey, key)
+	_, err = source.key("oct")
+	assert.Error(t, err)
+
+	// a rotated key is loaded for an unknown key id, but not more often than jwksMinRefresh
+	current, _ = json.Marshal(map[string][]JWK{"keys": {{Kid: "rotated", Kty: "EC", Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(otherKeys.ecKey.X.Bytes()), Y: base64.RawURLEncoding.EncodeToString(otherKeys.ecKey.Y.Bytes())}}})
+	_, err = source.key("rotated")
+	assert.Error(t, err)
+	source.attempted = time.Now().Add(-2 * jwksMinRefresh)
+	key, err = source.key("rotated")
+	assert.Nil(t, err)
+	assert.Equal(t, &otherKeys.ecKey.PublicKey, key)
+
+	// a failed load is retried after a doubled wait
+	current = nil
+	source.attempted = time.Now().Add(-2 * jwksMinRefresh)
+	requests = 0
+	_, err = source.key("unknown")
+	assert.Error(t, err)
+	_, err = source.key("unknown")
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 2*jwksMinRefresh, source.retryWait())
+	source.attempted = time.Now().Add(-jwksMinRefresh - time.Second)
+	_, _ = source.key("unknown")
+	assert.Equal(t, 1, requests)
+	source.attempted = time.Now().Add(-2*jwksMinRefresh - time.Second)
+	_, _ = source.key("unknown")
+	assert.Equal(t, 2, requests)
+	// the keys of the last successful load are still used
+	key, err = source.key("rotated")
+	assert.Nil(t, err)
+	assert.Equal(t, &otherKeys.ecKey.PublicKey, key)
+	hooks.Reset()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LockedError is returned if a state is changed without holding its lock
+type LockedError struct {
+	// LockInfo of the current lock or nil if the state is not locked
+	LockInfo *LockInfo
+}
+
+func (l *LockedError) Error() string {
+	if l.LockInfo == nil {
+		return "state is not locked"
+	}
+	return fmt.Sprintf("state is locked with id %s", l.LockInfo.ID)
+}
+
+// checkLockOwnership returns a LockedError if the state is locked with another
+// lock id than the given one. In strict mode a change of a not locked state is
+// refused too. A lock older than the ttl counts as not locked.
+func checkLockOwnership(store StateStore, tfID string, lockID string, strict bool, ttl time.Duration) error {
+	lockInfo, err := store.getLock(tfID)
+	if err != nil {
+		return err
+	}
+	if lockInfo != nil && lockExpired(*lockInfo, ttl, time.Now()) {
+		logger.Infof("lock %s of state %s is expired", lockInfo.ID, tfID)
+		lockInfo = nil
+	}
+	if lockInfo == nil {
+		if strict {
+			logger.Infof("state %s is not locked, but strict locking requires a lock", tfID)
+			return &LockedError{}
+		}
+		return nil
+	}
+	if lockInfo.ID != lockID {
+		logger.Infof("state is locked with diffrend id %s, but follow id requestd change %s", lockInfo.ID, lockID)
+		return &LockedError{LockInfo: lockInfo}
+	}
+
+	return nil
+}
+
+// writeLockedError answers a request refused because of a LockedError. If the state is
+// locked by someone else the current LockInfo is returned with status 423 (Locked),
+// if a lock is required but missing the status is 428 (Precondition Required).
+func writeLockedError(w http.ResponseWriter, locked *LockedError) {
+	if locked.LockInfo == nil {
+		writeStatus(w, http.StatusPreconditionRequired)
+		return
+	}
+	body, _ := json.Marshal(locked.LockInfo)
+	w.WriteHeader(http.StatusLocked)
+	_, _ = w.Write(body)
+}
+
+// writeConflictError answers a lock or unlock request refused because of a ConflictError.
+// Like expected by terraform the lock currently held on the state is returned as body.
+func writeConflictError(w http.ResponseWriter, conflict *ConflictError) {
+	if conflict.LockInfo == nil {
+		writeStatus(w, conflict.StatusCode)
+		return
+	}
+	body, _ := json.Marshal(conflict.LockInfo)
+	w.WriteHeader(conflict.StatusCode)
+	_, _ = w.Write(body)
+}
+
+// HeldLock is a lock held on a state
+type HeldLock struct {
+	StateID string `json:"state"`
+	LockInfo
+}
+
+// sameLock reports if both locks are the same lock and not renewed in between
+func sameLock(a LockInfo, b LockInfo) bool {
+	return a.ID == b.ID && a.Created.Equal(b.Created)
+}
+
+// lockExpired reports if the lock is older than the ttl. With a ttl of 0 a lock never expires.
+func lockExpired(lockInfo LockInfo, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(lockInfo.Created) > ttl
+}
+
+// renewLock sets the creation time of the lock to now, used if the lock holder
+// sends the lock again as heartbeat to prevent the expiry of the lock
+func renewLock(lock []byte, now time.Time) ([]byte, error) {
+	var lockInfo LockInfo
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		return nil, err
+	}
+	lockInfo.Created = now.UTC()
+
+	return json.Marshal(lockInfo)
+}
+
+// auditReclaimedLock records the removal of an expired lock
+func auditReclaimedLock(tfID string, lockInfo LockInfo, by string) {
+	audit("lock_reclaimed", by, logrus.Fields{"state": tfID, "lock_id": lockInfo.ID, "lock_who": lockInfo.Who, "lock_created": lockInfo.Created},
+		"expired lock %s of state %s created by %s at %s reclaimed", lockInfo.ID, tfID, lockInfo.Who, lockInfo.Created.Format(time.RFC3339))
+}
+
+// releaseLock removes the lock of a state regardless of its lock id and returns the released
+// lock. If the state is not locked nil is returned.
+func releaseLock(store StateStore, tfID string) (*LockInfo, error) {
+	lockInfo, err := store.getLock(tfID)
+	if err != nil || lockInfo == nil {
+		return nil, err
+	}
+	if err := store.removeLock(tfID, *lockInfo); err != nil {
+		return nil, err
+	}
+
+	return lockInfo, nil
+}
+
+// reapExpiredLocks removes all locks older than the ttl and returns the number of removed locks
+func reapExpiredLocks(store StateStore, ttl time.Duration) int {
+	var reaped int
+
+	locks, err := store.locks()
+	if err != nil {
+		logger.Warnf("Can't list locks to reap expired locks. Got follow error %v", err)
+		return 0
+	}
+	for _, held := range locks {
+		if !lockExpired(held.LockInfo, ttl, time.Now()) {
+			continue
+		}
+		// read the lock again and remove only this lock, so a lock renewed in the meantime is kept
+		lockInfo, err := store.getLock(held.StateID)
+		if err != nil || lockInfo == nil || !lockExpired(*lockInfo, ttl, time.Now()) {
+			continue
+		}
+		if err := store.removeLock(held.StateID, *lockInfo); err != nil {
+			logger.Warnf("Can't remove expired lock of state %s. Got follow error %v", held.StateID, err)
+			continue
+		}
+		auditReclaimedLock(held.StateID, *lockInfo, "lock reaper")
+		reaped++
+	}
+
+	return reaped
+}
+
+// startLockReaper removes the expired locks every interval until the returned stop function is called
+func startLockReaper(store StateStore, ttl time.Duration, interval time.Duration) func() {
+	var ticker = time.NewTicker(interval)
+	var done = make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if reaped := reapExpiredLocks(store, ttl); reaped > 0 {
+					logger.Infof("lock reaper removed %d expired locks", reaped)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
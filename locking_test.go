@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkLockOwnership(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfo := LockInfo{ID: "myid1", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfoBytes))
+	expiredBytes, _ := json.Marshal(LockInfo{ID: "myid2", Created: time.Now().Add(-2 * time.Hour).UTC()})
+	createFile(tmpTestDir, "expired_state.lock", string(expiredBytes))
+
+	type args struct {
+		tfID   string
+		lockID string
+		strict bool
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantLocked bool
+		wantLock   *LockInfo
+	}{
+		{"not locked", args{"unlocked_state", "", false}, false, nil},
+		{"not locked strict", args{"unlocked_state", "myid1", true}, true, nil},
+		{"locked by self", args{"locked_state", "myid1", true}, false, nil},
+		{"locked by other", args{"locked_state", "otherid", false}, true, &lockInfo},
+		{"locked without id", args{"locked_state", "", false}, true, &lockInfo},
+		{"expired lock of other", args{"expired_state", "otherid", false}, false, nil},
+		{"expired lock strict", args{"expired_state", "myid2", true}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var locked *LockedError
+
+			err := checkLockOwnership(&Backend{dir: tmpTestDir}, tt.args.tfID, tt.args.lockID, tt.args.strict, time.Hour)
+			if !tt.wantLocked {
+				assert.Nil(t, err)
+				return
+			}
+			if assert.ErrorAs(t, err, &locked) {
+				assert.Equal(t, tt.wantLock, locked.LockInfo)
+			}
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_writeLockedError(t *testing.T) {
+	lockInfo := LockInfo{ID: "myid1", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+
+	tests := []struct {
+		name       string
+		locked     *LockedError
+		wantStatus int
+		wantBody   string
+	}{
+		{"locked by other", &LockedError{LockInfo: &lockInfo}, http.StatusLocked, string(lockInfoBytes)},
+		{"lock required", &LockedError{}, http.StatusPreconditionRequired, "Precondition Required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			writeLockedError(rr, tt.locked)
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.Equal(t, tt.wantBody, rr.Body.String())
+		})
+	}
+}
+
+func Test_writeConflictError(t *testing.T) {
+	lockInfo := LockInfo{ID: "myid1", Who: "alice@host", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+
+	tests := []struct {
+		name     string
+		conflict *ConflictError
+		wantBody string
+	}{
+		{"with current lock", newLockConflictError(lockInfo), string(lockInfoBytes)},
+		{"without current lock", &ConflictError{StatusCode: http.StatusConflict}, "Conflict"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			writeConflictError(rr, tt.conflict)
+			assert.Equal(t, http.StatusConflict, rr.Code)
+			assert.Equal(t, tt.wantBody, rr.Body.String())
+		})
+	}
+}
+
+func TestLockedError_Error(t *testing.T) {
+	assert.Equal(t, "state is not locked", (&LockedError{}).Error())
+	assert.Equal(t, "state is locked with id myid1", (&LockedError{LockInfo: &LockInfo{ID: "myid1"}}).Error())
+}
+
+func Test_lockExpired(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		created time.Time
+		ttl     time.Duration
+		want    bool
+	}{
+		{"no ttl", now.Add(-24 * time.Hour), 0, false},
+		{"within ttl", now.Add(-time.Minute), time.Hour, false},
+		{"expired", now.Add(-2 * time.Hour), time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, lockExpired(LockInfo{Created: tt.created}, tt.ttl, now))
+		})
+	}
+}
+
+func Test_renewLock(t *testing.T) {
+	now := time.Now()
+	lockBytes, _ := json.Marshal(LockInfo{ID: "myid1", Who: "alice", Created: now.Add(-time.Hour).UTC()})
+	wantBytes, _ := json.Marshal(LockInfo{ID: "myid1", Who: "alice", Created: now.UTC()})
+
+	got, err := renewLock(lockBytes, now)
+	assert.Nil(t, err)
+	assert.Equal(t, wantBytes, got)
+
+	_, err = renewLock([]byte("no json"), now)
+	assert.Error(t, err)
+}
+
+func Test_releaseLock(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfo := LockInfo{ID: "myid1", Created: time.Now().UTC()}
+	lockInfoBytes, _ := json.Marshal(lockInfo)
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfoBytes))
+	store := &Backend{dir: tmpTestDir}
+
+	got, err := releaseLock(store, "locked_state")
+	assert.Nil(t, err)
+	assert.Equal(t, &lockInfo, got)
+	current, err := store.getLock("locked_state")
+	assert.Nil(t, err)
+	assert.Nil(t, current)
+
+	got, err = releaseLock(store, "locked_state")
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+	hooks.Reset()
+}
+
+func Test_reapExpiredLocks(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	expiredBytes, _ := json.Marshal(LockInfo{ID: "myid1", Who: "alice", Created: time.Now().Add(-2 * time.Hour).UTC()})
+	activeBytes, _ := json.Marshal(LockInfo{ID: "myid2", Who: "bob", Created: time.Now().UTC()})
+	createFile(tmpTestDir, "expired_state.lock", string(expiredBytes))
+	createFile(tmpTestDir, "active_state.lock", string(activeBytes))
+	store := &Backend{dir: tmpTestDir}
+
+	assert.Equal(t, 1, reapExpiredLocks(store, time.Hour))
+	checkLogMessage(t, []string{"expired lock myid1 of state expired_state created by alice at"})
+	lockInfo, err := store.getLock("expired_state")
+	assert.Nil(t, err)
+	assert.Nil(t, lockInfo)
+	lockInfo, err = store.getLock("active_state")
+	assert.Nil(t, err)
+	assert.Equal(t, "myid2", lockInfo.ID)
+
+	assert.Equal(t, 0, reapExpiredLocks(store, time.Hour))
+	hooks.Reset()
+}
+
+func Test_startLockReaper(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	expiredBytes, _ := json.Marshal(LockInfo{ID: "myid1", Created: time.Now().Add(-2 * time.Hour).UTC()})
+	createFile(tmpTestDir, "expired_state.lock", string(expiredBytes))
+	store := &Backend{dir: tmpTestDir}
+
+	stop := startLockReaper(store, time.Hour, 10*time.Millisecond)
+	defer stop()
+	assert.Eventually(t, func() bool {
+		lockInfo, err := store.getLock("expired_state")
+		return err == nil && lockInfo == nil
+	}, time.Second, 10*time.Millisecond)
+	hooks.Reset()
+}
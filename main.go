@@ -1,53 +1,134 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sirupsen/logrus"
 )
 
-var storageBackend Backend
+var storageBackend StateStore
 var config Config
 
+// writeStatus writes the status code with its text as body
+func writeStatus(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(http.StatusText(status)))
+}
+
+// readBody reads the request body. A body larger than the configured maximum size
+// is refused with 413, a maximum size of 0 doesn't limit the body.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var reader io.Reader = r.Body
+
+	if config.maxBodySize > 0 {
+		reader = io.LimitReader(r.Body, config.maxBodySize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest)
+		return nil, false
+	}
+	if config.maxBodySize > 0 && int64(len(body)) > config.maxBodySize {
+		logger.Infof("Refused body of %s larger than %d bytes", r.URL.Path, config.maxBodySize)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte(fmt.Sprintf("%s: body exceeds the maximum size of %d bytes", http.StatusText(http.StatusRequestEntityTooLarge), config.maxBodySize)))
+		return nil, false
+	}
+
+	return body, true
+}
+
 func getTfstate(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 	var err error
 	var e *fs.PathError
+	var notExists *FileNotExistsError
 
 	tfID := chi.URLParam(r, "id")
 	if body, err = storageBackend.get(tfID); err != nil {
+		if errors.As(err, &notExists) {
+			writeStatus(w, http.StatusNotFound)
+			return
+		}
 		if errors.As(err, &e) {
 			var operation = err.(*fs.PathError).Op
 			if operation == "stat" || operation == "CreateFile" {
-				w.WriteHeader(http.StatusNotFound)
-				_, _ = w.Write([]byte(http.StatusText(http.StatusNotFound)))
+				writeStatus(w, http.StatusNotFound)
 			} else {
 				logger.Warnf("Can not Access File: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+				writeStatus(w, http.StatusInternalServerError)
 			}
 			return
 		}
 		logger.Warnf("Complete unexpected Error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		writeStatus(w, http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(body)
+	if outputsOnlyView(r, tfID) {
+		writeOutputsOnly(w, tfID, body)
+		return
+	}
+	writeRedactable(w, r, tfID, body)
 }
 
 func updateTfstate(w http.ResponseWriter, r *http.Request) {
+	var locked *LockedError
+	var stateConflict *StateConflictError
+
 	tfID := chi.URLParam(r, "id")
-	reqBody, _ := ioutil.ReadAll(r.Body)
+	reqBody, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if err := checkLockOwnership(storageBackend, tfID, r.URL.Query().Get("ID"), config.lockStrict, config.lockTTL); err != nil {
+		if errors.As(err, &locked) {
+			writeLockedError(w, locked)
+			return
+		}
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if err := validateTfstate(reqBody); err != nil {
+		logger.Infof("Refused upload of state %s: %v", tfID, err)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusBadRequest) + ": invalid terraform state: " + err.Error()))
+		return
+	}
+	current, err := currentState(storageBackend, tfID)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if err := checkStateSuccession(tfID, current, reqBody); errors.As(err, &stateConflict) {
+		if r.Header.Get(forceReplaceHeader) != "true" {
+			logger.Infof("Refused upload: %v", err)
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusConflict) + ": " + stateConflict.Reason))
+			return
+		}
+		if reason := accessDenied(r, tfID, PermissionAdmin); reason != "" {
+			writeForbidden(w, reason)
+			return
+		}
+		who := requestUser(r)
+		audit("state_force_replaced", who, logrus.Fields{"state": tfID, "reason": stateConflict.Reason},
+			"state %s replaced by %s although %s", tfID, who, stateConflict.Reason)
+	}
 	if err := storageBackend.update(tfID, reqBody); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		writeStatus(w, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -55,10 +136,19 @@ func updateTfstate(w http.ResponseWriter, r *http.Request) {
 }
 
 func purgeTfstate(w http.ResponseWriter, r *http.Request) {
+	var locked *LockedError
+
 	tfID := chi.URLParam(r, "id")
+	if err := checkLockOwnership(storageBackend, tfID, r.URL.Query().Get("ID"), config.lockStrict, config.lockTTL); err != nil {
+		if errors.As(err, &locked) {
+			writeLockedError(w, locked)
+			return
+		}
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
 	if err := storageBackend.purge(tfID); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		writeStatus(w, http.StatusInternalServerError)
 		return
 	}
 	_, _ = w.Write([]byte("{\"state\": \"tfstate deleted\"}"))
@@ -70,15 +160,16 @@ func lockTfstate(w http.ResponseWriter, r *http.Request) {
 	var conflict *ConflictError
 
 	tfID := chi.URLParam(r, "id")
-	reqBody, _ := ioutil.ReadAll(r.Body)
+	reqBody, ok := readBody(w, r)
+	if !ok {
+		return
+	}
 	if lockFile, err = storageBackend.lock(tfID, reqBody); err != nil {
 		if errors.As(err, &conflict) {
-			w.WriteHeader(http.StatusConflict)
-			_, _ = w.Write([]byte(http.StatusText(http.StatusConflict)))
+			writeConflictError(w, conflict)
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		writeStatus(w, http.StatusInternalServerError)
 		return
 	}
 	_, _ = w.Write(lockFile)
@@ -88,41 +179,208 @@ func unlockTfstate(w http.ResponseWriter, r *http.Request) {
 	var conflict *ConflictError
 
 	tfID := chi.URLParam(r, "id")
-	reqBody, _ := ioutil.ReadAll(r.Body)
+	reqBody, ok := readBody(w, r)
+	if !ok {
+		return
+	}
 	if err := storageBackend.unlock(tfID, reqBody); err != nil {
 		if errors.As(err, &conflict) {
-			w.WriteHeader(http.StatusConflict)
-			_, _ = w.Write([]byte(http.StatusText(http.StatusConflict)))
+			writeConflictError(w, conflict)
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		writeStatus(w, http.StatusInternalServerError)
 		return
 	}
 	_, _ = w.Write(reqBody)
 }
 
-func handleRequests() {
-	logger.Debugf("current storage path: %s", config.storageDirectory)
-	storageBackend = Backend{dir: config.storageDirectory}
+func listTfstateVersions(w http.ResponseWriter, r *http.Request) {
+	tfID := chi.URLParam(r, "id")
+	versions, err := storageBackend.versions(tfID)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	body, _ := json.Marshal(versions)
+	_, _ = w.Write(body)
+}
+
+func getTfstateVersion(w http.ResponseWriter, r *http.Request) {
+	var notExists *VersionNotExistsError
+
+	tfID := chi.URLParam(r, "id")
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest)
+		return
+	}
+	body, err := storageBackend.getVersion(tfID, version)
+	if err != nil {
+		if errors.As(err, &notExists) {
+			writeStatus(w, http.StatusNotFound)
+			return
+		}
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	writeRedactable(w, r, tfID, body)
+}
+
+// RollbackRequest is the body of a rollback request
+type RollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// requestUser returns the name of the authenticated user who sent the request
+func requestUser(r *http.Request) string {
+	if identity := requestIdentity(r); identity != nil {
+		return identity.Name
+	}
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	return "anonymous@" + r.RemoteAddr
+}
+
+func rollbackTfstate(w http.ResponseWriter, r *http.Request) {
+	var rollback RollbackRequest
+	var locked *LockedError
+	var notExists *VersionNotExistsError
+
+	tfID := chi.URLParam(r, "id")
+	reqBody, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(reqBody, &rollback); err != nil || rollback.Version <= 0 {
+		writeStatus(w, http.StatusBadRequest)
+		return
+	}
+	body, err := rollbackState(storageBackend, tfID, rollback.Version, r.URL.Query().Get("ID"), config.lockStrict, config.lockTTL, requestUser(r))
+	if err != nil {
+		if errors.As(err, &locked) {
+			writeLockedError(w, locked)
+			return
+		}
+		if errors.As(err, &notExists) {
+			writeStatus(w, http.StatusNotFound)
+			return
+		}
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(body)
+}
 
+// newRouter creates the router of the main server. chi requires all middlewares
+// of a router to be added before its first route.
+func newRouter(c *Config) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
-
-	if config.authEnabled {
-		r.Use(middleware.BasicAuth("restricted access", config.getAuthMap()))
+	if c.metricsEnabled {
+		r.Use(instrumentRequests)
 	}
+	r.Use(refuseLocksWhileShuttingDown)
 
 	chi.RegisterMethod("LOCK")
 	chi.RegisterMethod("UNLOCK")
 	r.Use(middleware.SetHeader("Content-Type", "application/json"))
 
-	r.Get("/{id}", getTfstate)
-	r.Post("/{id}", updateTfstate)
-	r.Delete("/{id}", purgeTfstate)
-	r.MethodFunc("LOCK", "/{id}", lockTfstate)
-	r.MethodFunc("UNLOCK", "/{id}", unlockTfstate)
-	logger.Fatal(http.ListenAndServe(config.getAddr(), r))
+	if c.metricsEnabled && c.metricsAddr == "" {
+		r.Handle("/metrics", metricsHandler(storageBackend))
+	}
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+
+	if c.adminPassword != "" {
+		r.Mount("/admin", adminRouter(c))
+	}
+
+	r.Group(func(r chi.Router) {
+		if c.authEnabled {
+			authenticators, err := c.getAuthenticators()
+			if err != nil {
+				logger.Fatalf("Can't initialize authentication. Got follow error %v", err)
+			}
+			if apiTokens != nil {
+				authenticators = append([]Authenticator{apiTokens}, authenticators...)
+			}
+			r.Use(authenticate("restricted access", authenticators...))
+		}
+
+		r.Get("/resources", listResources)
+		r.Handle("/*", stateRouter())
+	})
+
+	return r
+}
+
+// newMetricsRouter creates the router of the separate metrics listener. It serves the health probes
+// too, as probes can't pass the client certificate authentication of the main listener.
+func newMetricsRouter(store StateStore) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.SetHeader("Content-Type", "application/json"))
+
+	r.Handle("/metrics", metricsHandler(store))
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+
+	return r
+}
+
+// handleRequests serves the requests until the server fails or is stopped by SIGINT or SIGTERM
+func handleRequests() error {
+	var err error
+	var servers []*http.Server
+	var listeners []net.Listener
+
+	logger.Debugf("current storage driver: %s", config.storageDriver)
+	if storageBackend, err = newStateStore(&config); err != nil {
+		logger.Fatalf("Can't initialize storage driver %s. Got follow error %v", config.storageDriver, err)
+	}
+	if config.metricsEnabled {
+		storageBackend = instrumentStore(storageBackend)
+	}
+	if config.aclFile != "" {
+		if accessPolicy, err = loadACLPolicy(config.aclFile); err != nil {
+			logger.Fatalf("Can't load acl file. Got follow error %v", err)
+		}
+	}
+	if config.tokenFile != "" {
+		if apiTokens, err = newTokenStore(config.tokenFile); err != nil {
+			logger.Fatalf("Can't load token file. Got follow error %v", err)
+		}
+	}
+	if config.lockTTL > 0 {
+		stopReaper := startLockReaper(storageBackend, config.lockTTL, config.lockReapInterval)
+		defer stopReaper()
+	}
+
+	tlsConfig, err := config.getTLSConfig()
+	if err != nil {
+		logger.Fatalf("Can't initialize tls. Got follow error %v", err)
+	}
+
+	servers = append(servers, &http.Server{Addr: config.getAddr(), Handler: newRouter(&config), TLSConfig: tlsConfig})
+	if config.metricsEnabled && config.metricsAddr != "" {
+		servers = append(servers, &http.Server{Addr: config.metricsAddr, Handler: newMetricsRouter(storageBackend)})
+	}
+
+	for _, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	return serve(servers, listeners, signals, config.shutdownTimeout)
 }
 
 func init() {
@@ -131,5 +389,14 @@ func init() {
 
 func main() {
 	config.loadConfig(".env")
-	handleRequests()
+	if err := SetupAuditLog(config.auditLog); err != nil {
+		logger.Fatalf("Can't open audit log %s. Got follow error %v", config.auditLog, err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout))
+	}
+	if err := handleRequests(); err != nil {
+		logger.Errorf("Server stopped with error %v", err)
+		os.Exit(1)
+	}
 }
@@ -43,7 +43,7 @@ func Test_getTfstate(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			storageBackend = Backend{tmpTestDir}
+			storageBackend = &Backend{dir: tmpTestDir}
 			router := chi.NewRouter()
 			router.Get("/{id}", getTfstate)
 			ts := httptest.NewServer(router)
@@ -82,11 +82,11 @@ func Test_lockTfstate(t *testing.T) {
 	}{
 		{"Defect lock json body", args{"jfkdslf", "not_file"}, 500, "Internal Server Error", []string{"unexpected decoding json error"}},
 		{"create new lock", args{string(lockInfo1Bytes), "not_file"}, 200, string(lockInfo1Bytes), nil},
-		{"conflict with existing lock", args{string(lockInfo1Bytes), "exists_statelock"}, 409, "Conflict", []string{"state is locked with diffrend id myid2, but follow id requestd lock myid1"}},
+		{"conflict with existing lock", args{string(lockInfo1Bytes), "exists_statelock"}, 409, string(lockInfo2Bytes), []string{"state is locked with diffrend id myid2, but follow id requestd lock myid1"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			storageBackend = Backend{tmpTestDir}
+			storageBackend = &Backend{dir: tmpTestDir}
 			router := chi.NewRouter()
 			chi.RegisterMethod("LOCK")
 			router.MethodFunc("LOCK", "/{id}", lockTfstate)
@@ -106,6 +106,9 @@ func Test_purgeTfstate(t *testing.T) {
 	defer cleanup()
 
 	createFile(tmpTestDir, "existing_state.tfstate", "This is the Content")
+	createFile(tmpTestDir, "locked_state.tfstate", "This is the Content")
+	lockInfoBytes, _ := json.Marshal(LockInfo{ID: "myid1", Created: time.Now().UTC()})
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfoBytes))
 
 	type args struct {
 		suburl string
@@ -131,10 +134,24 @@ func Test_purgeTfstate(t *testing.T) {
 			`{"state": "tfstate deleted"}`,
 			[]string{"no_file_exists.tfstate not found"},
 		},
+		{
+			"Delete locked file with other lock id",
+			args{"locked_state?ID=otherid"},
+			423,
+			string(lockInfoBytes),
+			[]string{"state is locked with diffrend id myid1, but follow id requestd change otherid"},
+		},
+		{
+			"Delete locked file with lock id",
+			args{"locked_state?ID=myid1"},
+			200,
+			`{"state": "tfstate deleted"}`,
+			nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			storageBackend = Backend{tmpTestDir}
+			storageBackend = &Backend{dir: tmpTestDir}
 			router := chi.NewRouter()
 			router.Delete("/{id}", purgeTfstate)
 			ts := httptest.NewServer(router)
@@ -189,7 +206,7 @@ func Test_unlockTfstate(t *testing.T) {
 			"conflict with existing lock",
 			args{"exists_statelock", string(lockInfo1Bytes)},
 			409,
-			"Conflict",
+			string(lockInfo2Bytes),
 			[]string{"state is locked with diffrend id myid2, but follow id requestd lock myid1"},
 		},
 		{
@@ -202,7 +219,7 @@ func Test_unlockTfstate(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			storageBackend = Backend{tmpTestDir}
+			storageBackend = &Backend{dir: tmpTestDir}
 			router := chi.NewRouter()
 			chi.RegisterMethod("UNLOCK")
 			router.MethodFunc("UNLOCK", "/{id}", unlockTfstate)
@@ -222,6 +239,9 @@ func Test_updateTfstate(t *testing.T) {
 	defer cleanup()
 
 	createFile(tmpTestDir, "existing_file", "old content")
+	lockInfoBytes, _ := json.Marshal(LockInfo{ID: "myid1", Created: time.Now().UTC()})
+	createFile(tmpTestDir, "locked_file.lock", string(lockInfoBytes))
+	state := testTfstate(1, "a1")
 
 	type args struct {
 		body   string
@@ -233,12 +253,17 @@ func Test_updateTfstate(t *testing.T) {
 		wantStatus int
 		wantBody   string
 	}{
-		{"create new file", args{"New File Content", "new_file"}, 200, "New File Content"},
-		{"update existing file", args{"updated content", "existing_file"}, 200, "updated content"},
+		{"create new file", args{state, "new_file"}, 200, state},
+		{"update existing file", args{state, "existing_file"}, 200, state},
+		{"update locked file without lock id", args{state, "locked_file"}, 423, string(lockInfoBytes)},
+		{"update locked file with other lock id", args{state, "locked_file?ID=otherid"}, 423, string(lockInfoBytes)},
+		{"update locked file with lock id", args{state, "locked_file?ID=myid1"}, 200, state},
+		{"empty body", args{"", "new_file"}, 400, "Bad Request: invalid terraform state: empty body"},
+		{"proxy error page", args{"<html><body>502 Bad Gateway</body></html>", "new_file"}, 400, "Bad Request: invalid terraform state: body is no json object"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			storageBackend = Backend{tmpTestDir}
+			storageBackend = &Backend{dir: tmpTestDir}
 			router := chi.NewRouter()
 			chi.RegisterMethod("UNLOCK")
 			router.MethodFunc("UNLOCK", "/{id}", updateTfstate)
@@ -256,3 +281,225 @@ func Test_updateTfstate(t *testing.T) {
 		})
 	}
 }
+
+func Test_listTfstateVersions(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	versions := []StateVersion{{Version: 1, Serial: 3, Created: time.Unix(1637940915, 0).UTC(), Size: 13}}
+	versionsBytes, _ := json.Marshal(versions)
+	createDirectoryFile(tmpTestDir, ".versions/with_versions", versionFileName(versions[0]), `{"serial": 3}`)
+
+	type args struct {
+		suburl string
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+		wantBody   string
+	}{
+		{"list versions", args{"with_versions"}, 200, string(versionsBytes)},
+		{"list no versions", args{"no_versions"}, 200, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			router := chi.NewRouter()
+			router.Get("/{id}/versions", listTfstateVersions)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", "/"+tt.args.suburl+"/versions", nil)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+}
+
+func Test_getTfstateVersion(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	version := StateVersion{Version: 2, Serial: 3, Created: time.Unix(1637940915, 0).UTC(), Size: 13}
+	createDirectoryFile(tmpTestDir, ".versions/with_versions", versionFileName(version), `{"serial": 3}`)
+
+	type args struct {
+		suburl string
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+		wantBody   string
+		wantLogs   []string
+	}{
+		{"get version", args{"with_versions/versions/2"}, 200, `{"serial": 3}`, nil},
+		{"get unknown version", args{"with_versions/versions/1"}, 404, "Not Found", []string{"Version 1 of state with_versions not found"}},
+		{"get invalid version", args{"with_versions/versions/latest"}, 400, "Bad Request", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			router := chi.NewRouter()
+			router.Get("/{id}/versions/{version}", getTfstateVersion)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", "/"+tt.args.suburl, nil)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+			checkLogMessage(t, tt.wantLogs)
+		})
+	}
+}
+
+func Test_rollbackTfstate(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	store := &Backend{dir: tmpTestDir}
+	_ = store.update("rollback_state", []byte(`{"serial": 1}`))
+	_ = store.update("rollback_state", []byte(`{"serial": 2}`))
+	_ = store.update("locked_state", []byte(`{"serial": 1}`))
+	_ = store.update("locked_state", []byte(`{"serial": 2}`))
+	lockInfoBytes, _ := json.Marshal(LockInfo{ID: "myid1", Created: time.Now().UTC()})
+	createFile(tmpTestDir, "locked_state.lock", string(lockInfoBytes))
+
+	type args struct {
+		suburl string
+		body   string
+	}
+	defer func(lockStrict bool) {
+		config.lockStrict = lockStrict
+	}(config.lockStrict)
+
+	tests := []struct {
+		name       string
+		args       args
+		lockStrict bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"invalid body", args{"rollback_state/rollback", "jfkdslf"}, false, 400, "Bad Request"},
+		{"missing version", args{"rollback_state/rollback", "{}"}, false, 400, "Bad Request"},
+		{"unknown version", args{"rollback_state/rollback", `{"version": 5}`}, false, 404, "Not Found"},
+		{"locked by other", args{"locked_state/rollback?ID=otherid", `{"version": 1}`}, false, 423, string(lockInfoBytes)},
+		{"locked by self", args{"locked_state/rollback?ID=myid1", `{"version": 1}`}, true, 200, `{"serial": 1}`},
+		{"strict without lock", args{"rollback_state/rollback", `{"version": 1}`}, true, 428, "Precondition Required"},
+		{"rollback", args{"rollback_state/rollback", `{"version": 1}`}, false, 200, `{"serial": 1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.lockStrict = tt.lockStrict
+			storageBackend = store
+			router := chi.NewRouter()
+			router.Post("/{id}/rollback", rollbackTfstate)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "POST", "/"+tt.args.suburl, strings.NewReader(tt.args.body))
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	current, _ := store.get("rollback_state")
+	assert.Equal(t, []byte(`{"serial": 1}`), current)
+	assert.Contains(t, hooks.LastEntry().Data["who"], "anonymous@")
+	hooks.Reset()
+}
+
+func Test_readBody(t *testing.T) {
+	defer func(maxBodySize int64) {
+		config.maxBodySize = maxBodySize
+	}(config.maxBodySize)
+
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		body        string
+		wantStatus  int
+		wantBody    string
+	}{
+		{"below maximum", 10, "0123456789", 200, "0123456789"},
+		{"above maximum", 10, "0123456789a", 413, "Request Entity Too Large: body exceeds the maximum size of 10 bytes"},
+		{"unlimited", 0, "0123456789a", 200, "0123456789a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.maxBodySize = tt.maxBodySize
+			w := httptest.NewRecorder()
+			body, ok := readBody(w, httptest.NewRequest("POST", "/state", strings.NewReader(tt.body)))
+			if ok {
+				_, _ = w.Write(body)
+			}
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_newRouter(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+	resetMetrics()
+
+	tests := []struct {
+		name        string
+		config      Config
+		wantMetrics int
+	}{
+		{"without metrics", Config{}, 400},
+		{"metrics on main server", Config{metricsEnabled: true}, 200},
+		{"metrics on own server", Config{metricsEnabled: true, metricsAddr: "127.0.0.1:9100"}, 400},
+		{"metrics with admin api", Config{metricsEnabled: true, adminUsername: "admin", adminPassword: "secret"}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			ts := httptest.NewServer(newRouter(&tt.config))
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", "/metrics", nil)
+			assert.Equal(t, tt.wantMetrics, rr.StatusCode)
+			if tt.wantMetrics == 200 {
+				assert.Contains(t, got, "# TYPE terraform_http_requests_total counter")
+			}
+			rr, _ = testRequest(t, ts, "GET", "/healthz", nil)
+			assert.Equal(t, 200, rr.StatusCode)
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_newMetricsRouter(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+	resetMetrics()
+
+	tests := []struct {
+		name            string
+		suburl          string
+		wantStatus      int
+		wantContentType string
+	}{
+		{"metrics", "/metrics", 200, metricsContentType},
+		{"liveness probe", "/healthz", 200, "application/json"},
+		{"readiness probe", "/readyz", 200, "application/json"},
+		{"no states", "/team/state", 404, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			ts := httptest.NewServer(newMetricsRouter(storageBackend))
+			defer ts.Close()
+
+			rr, _ := testRequest(t, ts, "GET", tt.suburl, nil)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantContentType, rr.Header.Get("Content-Type"))
+		})
+	}
+	hooks.Reset()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// metricsContentType is the content type of the prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// requestDurationBuckets are the upper bounds in seconds of the request duration histogram
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// stateSizeBuckets are the upper bounds in bytes of the state size histogram
+var stateSizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+// metric is written in the prometheus text format
+type metric interface {
+	write(b *strings.Builder)
+}
+
+// metricSeries is a value of a metric with a combination of label values
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// buckets and count are only used by histograms
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec is a counter, gauge or histogram with labels
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*metricSeries
+}
+
+func newMetricVec(kind string, name string, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	// a metric without labels is exposed with its zero value before it is used
+	if len(labels) == 0 {
+		m.with(nil)
+	}
+
+	return m
+}
+
+// with returns the series of the label values, the caller has to hold the lock
+func (m *metricVec) with(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	series, ok := m.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues, buckets: make([]uint64, len(m.buckets))}
+		m.series[key] = series
+	}
+	return series
+}
+
+func (m *metricVec) add(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value += value
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value = value
+}
+
+func (m *metricVec) remove(labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metricVec) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series := m.with(labelValues)
+	series.value += value
+	series.count++
+	for i, bound := range m.buckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+}
+
+func (m *metricVec) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := m.series[key]
+		labels := formatLabels(m.labels, series.labelValues)
+		if m.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, labels, formatValue(series.value))
+			continue
+		}
+		bucketLabels := append(append([]string{}, m.labels...), "le")
+		for i, bound := range m.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, formatLabels(bucketLabels, append(append([]string{}, series.labelValues...), formatValue(bound))), series.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, formatLabels(bucketLabels, append(append([]string{}, series.labelValues...), "+Inf")), series.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, labels, formatValue(series.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name, labels, series.count)
+	}
+}
+
+// gaugeFunc is a gauge without labels calculated on every scrape
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() (float64, error)
+}
+
+func (g *gaugeFunc) write(b *strings.Builder) {
+	value, err := g.value()
+	if err != nil {
+		logger.Warnf("Can't collect metric %s. Got follow error %v", g.name, err)
+		return
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(value))
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	requestsTotal    = newMetricVec("counter", "terraform_http_requests_total", "Number of http requests by method and status.", nil, "method", "status")
+	requestDuration  = newMetricVec("histogram", "terraform_http_request_duration_seconds", "Duration of the http requests by method.", requestDurationBuckets, "method")
+	lockAcquisitions = newMetricVec("counter", "terraform_lock_acquisitions_total", "Number of acquired or renewed state locks.", nil)
+	lockConflicts    = newMetricVec("counter", "terraform_lock_conflicts_total", "Number of lock and unlock requests refused because of another lock.", nil)
+	stateSize        = newMetricVec("histogram", "terraform_state_size_bytes", "Size of the written states.", stateSizeBuckets)
+	storageErrors    = newMetricVec("counter", "terraform_storage_errors_total", "Number of failed storage operations.", nil, "operation")
+	authFailures     = newMetricVec("counter", "terraform_auth_failures_total", "Number of refused requests because of failed authentication or missing permissions.", nil, "reason")
+)
+
+// knownMethods limits the method label to the methods used by terraform and the admin api
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodPost: true, http.MethodPut: true, http.MethodDelete: true, "LOCK": true, "UNLOCK": true,
+}
+
+// instrumentRequests is a middleware counting the requests and measuring their duration
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestsTotal.inc(method, strconv.Itoa(status))
+		requestDuration.observe(time.Since(start).Seconds(), method)
+	})
+}
+
+// metricsHandler writes all metrics in the prometheus text format
+func metricsHandler(store StateStore) http.Handler {
+	heldLocks := &gaugeFunc{name: "terraform_locks_held", help: "Number of currently held state locks.", value: func() (float64, error) {
+		locks, err := store.locks()
+		return float64(len(locks)), err
+	}}
+	metrics := []metric{requestsTotal, requestDuration, lockAcquisitions, lockConflicts, heldLocks, stateSize, storageErrors, authFailures}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+
+		for _, m := range metrics {
+			m.write(&b)
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		_, _ = w.Write([]byte(b.String()))
+	})
+}
+
+// instrumentedStore counts the lock operations and failed operations of a StateStore
+type instrumentedStore struct {
+	StateStore
+}
+
+func instrumentStore(store StateStore) StateStore {
+	return &instrumentedStore{StateStore: store}
+}
+
+// countError counts unexpected errors of the storage, a missing state or lock conflict is no storage error
+func countError(operation string, err error) error {
+	var notExists *FileNotExistsError
+	var versionNotExists *VersionNotExistsError
+	var conflict *ConflictError
+
+	if err == nil || errors.As(err, &notExists) || errors.As(err, &versionNotExists) || errors.As(err, &conflict) || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	storageErrors.inc(operation)
+
+	return err
+}
+
+func (s *instrumentedStore) get(tfID string) ([]byte, error) {
+	body, err := s.StateStore.get(tfID)
+	return body, countError("get", err)
+}
+
+func (s *instrumentedStore) update(tfID string, tfstate []byte) error {
+	if err := s.StateStore.update(tfID, tfstate); err != nil {
+		return countError("update", err)
+	}
+	// no label per state, the state ids are not public and their number is unbounded
+	stateSize.observe(float64(len(tfstate)))
+	return nil
+}
+
+func (s *instrumentedStore) purge(tfID string) error {
+	return countError("purge", s.StateStore.purge(tfID))
+}
+
+func (s *instrumentedStore) lock(tfID string, lock []byte) ([]byte, error) {
+	var conflict *ConflictError
+
+	body, err := s.StateStore.lock(tfID, lock)
+	switch {
+	case err == nil:
+		lockAcquisitions.inc()
+	case errors.As(err, &conflict):
+		lockConflicts.inc()
+	}
+	return body, countError("lock", err)
+}
+
+func (s *instrumentedStore) unlock(tfID string, lock []byte) error {
+	var conflict *ConflictError
+
+	err := s.StateStore.unlock(tfID, lock)
+	if errors.As(err, &conflict) {
+		lockConflicts.inc()
+	}
+	return countError("unlock", err)
+}
+
+func (s *instrumentedStore) getLock(tfID string) (*LockInfo, error) {
+	lockInfo, err := s.StateStore.getLock(tfID)
+	return lockInfo, countError("get_lock", err)
+}
+
+func (s *instrumentedStore) removeLock(tfID string, lockInfo LockInfo) error {
+	return countError("remove_lock", s.StateStore.removeLock(tfID, lockInfo))
+}
+
+func (s *instrumentedStore) locks() ([]HeldLock, error) {
+	locks, err := s.StateStore.locks()
+	return locks, countError("locks", err)
+}
+
+func (s *instrumentedStore) states() ([]string, error) {
+	states, err := s.StateStore.states()
+	return states, countError("states", err)
+}
+
+func (s *instrumentedStore) versions(tfID string) ([]StateVersion, error) {
+	versions, err := s.StateStore.versions(tfID)
+	return versions, countError("versions", err)
+}
+
+func (s *instrumentedStore) ping() error {
+	return countError("ping", s.StateStore.ping())
+}
+
+func (s *instrumentedStore) getVersion(tfID string, version int) ([]byte, error) {
+	body, err := s.StateStore.getVersion(tfID, version)
+	return body, countError("get_version", err)
+}
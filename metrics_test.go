@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resetMetrics removes all values of the metrics
+func resetMetrics() {
+	for _, m := range []*metricVec{requestsTotal, requestDuration, lockAcquisitions, lockConflicts, stateSize, storageErrors, authFailures} {
+		m.series = make(map[string]*metricSeries)
+		if len(m.labels) == 0 {
+			m.with(nil)
+		}
+	}
+}
+
+func Test_metricVec_write(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric *metricVec
+		update func(m *metricVec)
+		want   string
+	}{
+		{
+			"counter without labels",
+			newMetricVec("counter", "test_total", "Test counter.", nil),
+			func(m *metricVec) {},
+			"# HELP test_total Test counter.\n# TYPE test_total counter\ntest_total 0\n",
+		},
+		{
+			"counter with labels",
+			newMetricVec("counter", "test_total", "Test counter.", nil, "method", "status"),
+			func(m *metricVec) {
+				m.inc("GET", "200")
+				m.inc("GET", "200")
+				m.add(3, "LOCK", "409")
+			},
+			"# HELP test_total Test counter.\n# TYPE test_total counter\n" +
+				"test_total{method=\"GET\",status=\"200\"} 2\ntest_total{method=\"LOCK\",status=\"409\"} 3\n",
+		},
+		{
+			"gauge",
+			newMetricVec("gauge", "test_bytes", "Test gauge.", nil, "state"),
+			func(m *metricVec) {
+				m.set(10, "a")
+				m.set(5, "a")
+				m.set(1, "b\"c")
+				m.set(2, "d")
+				m.remove("d")
+			},
+			"# HELP test_bytes Test gauge.\n# TYPE test_bytes gauge\ntest_bytes{state=\"a\"} 5\ntest_bytes{state=\"b\\\"c\"} 1\n",
+		},
+		{
+			"histogram",
+			newMetricVec("histogram", "test_seconds", "Test histogram.", []float64{0.1, 1}, "method"),
+			func(m *metricVec) {
+				m.observe(0.05, "GET")
+				m.observe(0.5, "GET")
+				m.observe(2, "GET")
+			},
+			"# HELP test_seconds Test histogram.\n# TYPE test_seconds histogram\n" +
+				"test_seconds_bucket{method=\"GET\",le=\"0.1\"} 1\ntest_seconds_bucket{method=\"GET\",le=\"1\"} 2\n" +
+				"test_seconds_bucket{method=\"GET\",le=\"+Inf\"} 3\ntest_seconds_sum{method=\"GET\"} 2.55\ntest_seconds_count{method=\"GET\"} 3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+
+			tt.update(tt.metric)
+			tt.metric.write(&b)
+			assert.Equal(t, tt.want, b.String())
+		})
+	}
+}
+
+func Test_instrumentRequests(t *testing.T) {
+	resetMetrics()
+	handler := instrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "LOCK" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	for _, method := range []string{"GET", "GET", "LOCK", "BREW"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/state", nil))
+	}
+
+	assert.Equal(t, float64(2), requestsTotal.series["GET\xff200"].value)
+	assert.Equal(t, float64(1), requestsTotal.series["LOCK\xff409"].value)
+	assert.Equal(t, float64(1), requestsTotal.series["OTHER\xff200"].value)
+	assert.Equal(t, uint64(2), requestDuration.series["GET"].count)
+}
+
+func Test_instrumentedStore(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+	resetMetrics()
+
+	store := instrumentStore(&Backend{dir: tmpTestDir})
+	lock1 := []byte(`{"ID":"1","Operation":"OperationTypePlan","Who":"alice"}`)
+	lock2 := []byte(`{"ID":"2","Operation":"OperationTypePlan","Who":"bob"}`)
+
+	assert.Nil(t, store.update("team/state", []byte(`{"version": 4}`)))
+	_, err := store.get("missing")
+	assert.Error(t, err)
+	_, err = store.lock("team/state", lock1)
+	assert.Nil(t, err)
+	_, err = store.lock("team/state", lock2)
+	assert.Error(t, err)
+	assert.Error(t, store.unlock("team/state", lock2))
+
+	assert.Equal(t, float64(len(`{"version": 4}`)), stateSize.series[""].value)
+	assert.Equal(t, uint64(1), stateSize.series[""].count)
+	assert.Equal(t, uint64(1), stateSize.series[""].buckets[0])
+	assert.Equal(t, float64(1), lockAcquisitions.series[""].value)
+	assert.Equal(t, float64(2), lockConflicts.series[""].value)
+	assert.Empty(t, storageErrors.series)
+
+	assert.Nil(t, store.unlock("team/state", lock1))
+	assert.Nil(t, store.purge("team/state"))
+
+	assert.Equal(t, errors.New("broken"), countError("update", errors.New("broken")))
+	assert.Equal(t, float64(1), storageErrors.series["update"].value)
+	hooks.Reset()
+}
+
+func Test_metricsHandler(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+	resetMetrics()
+
+	store := instrumentStore(&Backend{dir: tmpTestDir})
+	_, _ = store.lock("a", []byte(`{"ID":"1"}`))
+	_, _ = store.lock("b", []byte(`{"ID":"2"}`))
+	authFailures.inc("unauthenticated")
+
+	w := httptest.NewRecorder()
+	metricsHandler(store).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, metricsContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "\nterraform_locks_held 2\n")
+	assert.Contains(t, w.Body.String(), "\nterraform_lock_acquisitions_total 2\n")
+	assert.Contains(t, w.Body.String(), "\nterraform_auth_failures_total{reason=\"unauthenticated\"} 1\n")
+	assert.Contains(t, w.Body.String(), "# TYPE terraform_http_request_duration_seconds histogram\n")
+	hooks.Reset()
+}
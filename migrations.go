@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrate applies all migrations not yet recorded in the schema_migrations table
+// in one transaction. The version of a migration is its position in the list
+// starting with 1, so migrations must only be appended and never changed once
+// released. The optional lockStatement is executed first in the transaction to
+// serialize migrations of concurrently starting servers.
+func migrate(db *sql.DB, lockStatement string, migrations []string) error {
+	var current int
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if lockStatement != "" {
+		if _, err := tx.Exec(lockStatement); err != nil {
+			return fmt.Errorf("can't lock schema for migration: %w", err)
+		}
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("can't create schema_migrations table: %w", err)
+	}
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("can't read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			return fmt.Errorf("can't apply migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO schema_migrations (version) VALUES (%d)", version)); err != nil {
+			return fmt.Errorf("can't record migration %d: %w", version, err)
+		}
+		logger.Infof("applied schema migration %d", version)
+	}
+
+	return tx.Commit()
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
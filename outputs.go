@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// StateOutput is an output of the root module of a terraform state
+type StateOutput struct {
+	Value     json.RawMessage `json:"value"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Sensitive bool            `json:"sensitive,omitempty"`
+}
+
+// stateOutputs returns the outputs of the root module of a state. A state of version 4
+// contains only the root module outputs, a state of version 3 contains them in the
+// module with the path ["root"].
+func stateOutputs(tfstate []byte) (map[string]StateOutput, error) {
+	var state struct {
+		Version int                    `json:"version"`
+		Outputs map[string]StateOutput `json:"outputs"`
+		Modules []struct {
+			Path    []string               `json:"path"`
+			Outputs map[string]StateOutput `json:"outputs"`
+		} `json:"modules"`
+	}
+
+	if err := json.Unmarshal(tfstate, &state); err != nil {
+		return nil, fmt.Errorf("can't parse state: %w", err)
+	}
+	switch state.Version {
+	case 4:
+		if state.Outputs == nil {
+			return map[string]StateOutput{}, nil
+		}
+		return state.Outputs, nil
+	case 3:
+		for _, module := range state.Modules {
+			if len(module.Path) == 1 && module.Path[0] == "root" && module.Outputs != nil {
+				return module.Outputs, nil
+			}
+		}
+		return map[string]StateOutput{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported state version %d", state.Version)
+}
+
+// outputsOnlyTfstate returns the state without its resources, keeping only the root module outputs, so
+// terraform_remote_state can read the outputs without getting the attributes of the resources
+func outputsOnlyTfstate(tfstate []byte) ([]byte, error) {
+	var state map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(tfstate))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state); err != nil {
+		return nil, fmt.Errorf("can't parse state: %w", err)
+	}
+	outputs, err := stateOutputs(tfstate)
+	if err != nil {
+		return nil, err
+	}
+	view := map[string]interface{}{}
+	for _, key := range []string{"version", "terraform_version", "serial", "lineage"} {
+		if value, ok := state[key]; ok {
+			view[key] = value
+		}
+	}
+	if fmt.Sprint(state["version"]) == "3" {
+		view["modules"] = []interface{}{map[string]interface{}{"path": []string{"root"}, "outputs": outputs, "resources": map[string]interface{}{}}}
+	} else {
+		view["outputs"] = outputs
+		view["resources"] = []interface{}{}
+	}
+
+	return json.Marshal(view)
+}
+
+// outputsOnlyView reports if the requesting user only gets the outputs of the state, which is the
+// case for users allowed to read the state by the read_outputs permission only
+func outputsOnlyView(r *http.Request, tfID string) bool {
+	return accessDenied(r, tfID, PermissionReadRedacted) != "" && accessDenied(r, tfID, PermissionWrite) != ""
+}
+
+// authorizeStateRead is a middleware refusing requests for a state with 403 if the requesting user
+// has none of the read, read_redacted and read_outputs permissions on the state. The missing read
+// permission is reported as reason.
+func authorizeStateRead(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tfID := chi.URLParam(r, "id")
+		if accessDenied(r, tfID, PermissionReadRedacted) != "" && accessDenied(r, tfID, PermissionReadOutputs) != "" {
+			writeForbidden(w, accessDenied(r, tfID, PermissionRead))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeOutputsOnly writes the state reduced to its outputs
+func writeOutputsOnly(w http.ResponseWriter, tfID string, tfstate []byte) {
+	view, err := outputsOnlyTfstate(tfstate)
+	if err != nil {
+		logger.Warnf("Can not read outputs of state %s: %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(view)
+}
+
+// readStateOutputs returns the outputs of the stored state or writes the error status
+func readStateOutputs(w http.ResponseWriter, tfID string) (map[string]StateOutput, bool) {
+	current, err := currentState(storageBackend, tfID)
+	if err != nil {
+		logger.Warnf("Can not read state %s: %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return nil, false
+	}
+	if current == nil {
+		writeStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	outputs, err := stateOutputs(current)
+	if err != nil {
+		logger.Warnf("Can not read outputs of state %s: %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return outputs, true
+}
+
+func getTfstateOutputs(w http.ResponseWriter, r *http.Request) {
+	outputs, ok := readStateOutputs(w, chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	body, _ := json.Marshal(outputs)
+	_, _ = w.Write(body)
+}
+
+func getTfstateOutput(w http.ResponseWriter, r *http.Request) {
+	outputs, ok := readStateOutputs(w, chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	output, ok := outputs[chi.URLParam(r, "name")]
+	if !ok {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+	body, _ := json.Marshal(output)
+	_, _ = w.Write(body)
+}
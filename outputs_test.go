@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOutputsTfstate = `{"version": 4, "terraform_version": "1.5.7", "serial": 3, "lineage": "a1", "outputs": {
+  "vpc_id": {"value": "vpc-1", "type": "string"},
+  "subnets": {"value": ["a", "b"], "type": ["list", "string"]},
+  "db_password": {"value": "secret", "type": "string", "sensitive": true}
+}, "resources": [{"mode": "managed", "type": "aws_vpc", "name": "main", "instances": []}]}`
+
+func Test_stateOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		tfstate string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"version 4", testOutputsTfstate, map[string]string{"vpc_id": `"vpc-1"`, "subnets": `["a", "b"]`, "db_password": `"secret"`}, false},
+		{"version 4 without outputs", testTfstate(1, "a1"), map[string]string{}, false},
+		{"version 3", `{"version": 3, "serial": 1, "modules": [{"path": ["root", "vpc"], "outputs": {"id": {"value": "vpc-2"}}}, {"path": ["root"], "outputs": {"vpc_id": {"sensitive": false, "type": "string", "value": "vpc-1"}}}]}`, map[string]string{"vpc_id": `"vpc-1"`}, false},
+		{"version 3 without root module", `{"version": 3, "serial": 1, "modules": []}`, map[string]string{}, false},
+		{"unsupported version", `{"version": 5}`, nil, true},
+		{"no json", "<html>", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputs, err := stateOutputs([]byte(tt.tfstate))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			got := make(map[string]string)
+			for name, output := range outputs {
+				got[name] = string(output.Value)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_outputsOnlyTfstate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tfstate string
+		want    string
+		wantErr bool
+	}{
+		{"version 4", testOutputsTfstate, `{"lineage":"a1","outputs":{"db_password":{"value":"secret","type":"string","sensitive":true},"subnets":{"value":["a","b"],"type":["list","string"]},"vpc_id":{"value":"vpc-1","type":"string"}},"resources":[],"serial":3,"terraform_version":"1.5.7","version":4}`, false},
+		{"version 4 without outputs", testTfstate(1, "a1"), `{"lineage":"a1","outputs":{},"resources":[],"serial":1,"terraform_version":"1.5.7","version":4}`, false},
+		{"version 3", `{"version": 3, "serial": 1, "lineage": "a1", "modules": [{"path": ["root"], "outputs": {"vpc_id": {"type": "string", "value": "vpc-1"}}, "resources": {"aws_vpc.main": {}}}]}`, `{"lineage":"a1","modules":[{"outputs":{"vpc_id":{"value":"vpc-1","type":"string"}},"path":["root"],"resources":{}}],"serial":1,"version":3}`, false},
+		{"unsupported version", `{"version": 5}`, "", true},
+		{"no json", "<html>", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := outputsOnlyTfstate([]byte(tt.tfstate))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func Test_getTfstateOutputs(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createDirectoryFile(tmpTestDir, "team", "network.tfstate", testOutputsTfstate)
+	createDirectoryFile(tmpTestDir, "team", "broken.tfstate", `{"version": 5}`)
+
+	tests := []struct {
+		name       string
+		suburl     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"all outputs", "/team/network/outputs", 200, `{"db_password":{"value":"secret","type":"string","sensitive":true},"subnets":{"value":["a","b"],"type":["list","string"]},"vpc_id":{"value":"vpc-1","type":"string"}}`},
+		{"single output", "/team/network/outputs/subnets", 200, `{"value":["a","b"],"type":["list","string"]}`},
+		{"unknown output", "/team/network/outputs/missing", 404, "Not Found"},
+		{"unknown state", "/team/missing/outputs", 404, "Not Found"},
+		{"unknown state output", "/team/missing/outputs/vpc_id", 404, "Not Found"},
+		{"unsupported state", "/team/broken/outputs", 500, "Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			router := chi.NewRouter()
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", tt.suburl, nil)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	hooks.Reset()
+}
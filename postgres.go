@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	_ "github.com/lib/pq" // register the postgres database/sql driver
+)
+
+// postgresMigrationLock is the advisory lock key used to serialize schema migrations
+const postgresMigrationLock = 7364637269
+
+var postgresMigrations = []string{
+	`CREATE TABLE states (
+		id         TEXT PRIMARY KEY,
+		content    BYTEA NOT NULL,
+		size       INTEGER NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE locks (
+		id         TEXT PRIMARY KEY,
+		lock_id    TEXT NOT NULL,
+		operation  TEXT NOT NULL,
+		info       TEXT NOT NULL,
+		who        TEXT NOT NULL,
+		version    TEXT NOT NULL,
+		created    TIMESTAMPTZ NOT NULL,
+		path       TEXT NOT NULL,
+		content    BYTEA NOT NULL,
+		locked_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`,
+	`CREATE TABLE state_versions (
+		id         TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		serial     BIGINT NOT NULL,
+		content    BYTEA NOT NULL,
+		size       INTEGER NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (id, version)
+	);`,
+}
+
+// PostgresBackend is the "postgres" storage driver storing the states and
+// LockInfo rows in a PostgreSQL database shared by all server replicas.
+// Lock, unlock and update take a transaction scoped advisory lock on the
+// state id, so concurrent requests of different replicas are serialized.
+type PostgresBackend struct {
+	db        *sql.DB
+	retention HistoryRetention
+	lockTTL   time.Duration
+}
+
+func init() {
+	RegisterStorageDriver("postgres", newPostgresBackend)
+}
+
+func newPostgresBackend(c *Config) (StateStore, error) {
+	if c.postgresDSN == "" {
+		return nil, errors.New("no postgres dsn configured")
+	}
+	db, err := sql.Open("postgres", c.postgresDSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("can't connect to postgres: %w", err)
+	}
+
+	if err := migrate(db, fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", postgresMigrationLock), postgresMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &PostgresBackend{db: db, retention: c.getHistoryRetention(), lockTTL: c.lockTTL}, nil
+}
+
+func (p *PostgresBackend) get(tfID string) ([]byte, error) {
+	var id = normalizeStateID(tfID)
+	var tfstate []byte
+
+	err := p.db.QueryRow("SELECT content FROM states WHERE id = $1", id).Scan(&tfstate)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Infof("State %s not found", id)
+		return nil, &FileNotExistsError{Info: fmt.Sprintf("state %s not found", id)}
+	}
+	if err != nil {
+		logger.Warnf("Can't read state %s. With follow error %v", id, err)
+		return nil, err
+	}
+
+	return tfstate, nil
+}
+
+func (p *PostgresBackend) update(tfID string, tfstate []byte) error {
+	var id = normalizeStateID(tfID)
+
+	err := p.transaction(id, func(tx *sql.Tx) error {
+		var current []byte
+
+		err := tx.QueryRow("SELECT content FROM states WHERE id = $1", id).Scan(&current)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil && !bytes.Equal(current, tfstate) {
+			if err := p.archive(tx, id, current, time.Now()); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(
+			`INSERT INTO states (id, content, size) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO UPDATE SET content = excluded.content, size = excluded.size, updated_at = now()`,
+			id, tfstate, len(tfstate),
+		)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Can't write state %s. Got follow error %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// archive keeps the current state as new version and removes the versions outside of the retention
+func (p *PostgresBackend) archive(tx *sql.Tx, id string, current []byte, now time.Time) error {
+	versions, err := p.queryVersions(tx, id)
+	if err != nil {
+		return err
+	}
+	version := newStateVersion(versions, current, now)
+	if _, err := tx.Exec(
+		"INSERT INTO state_versions (id, version, serial, content, size, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		id, version.Version, version.Serial, current, version.Size, version.Created,
+	); err != nil {
+		return err
+	}
+	for _, expired := range p.retention.expired(append(versions, version), now) {
+		if _, err := tx.Exec("DELETE FROM state_versions WHERE id = $1 AND version = $2", id, expired.Version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *PostgresBackend) versions(tfID string) ([]StateVersion, error) {
+	var id = normalizeStateID(tfID)
+
+	versions, err := p.queryVersions(p.db, id)
+	if err != nil {
+		logger.Warnf("Can't read versions of state %s. With follow error %v", id, err)
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (p *PostgresBackend) queryVersions(db sqlQuerier, id string) ([]StateVersion, error) {
+	var versions = []StateVersion{}
+
+	rows, err := db.Query("SELECT version, serial, size, created_at FROM state_versions WHERE id = $1 ORDER BY version", id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var version StateVersion
+		if err := rows.Scan(&version.Version, &version.Serial, &version.Size, &version.Created); err != nil {
+			return nil, err
+		}
+		version.Created = version.Created.UTC()
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func (p *PostgresBackend) getVersion(tfID string, version int) ([]byte, error) {
+	var id = normalizeStateID(tfID)
+	var tfstate []byte
+
+	err := p.db.QueryRow("SELECT content FROM state_versions WHERE id = $1 AND version = $2", id, version).Scan(&tfstate)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Infof("Version %d of state %s not found", version, id)
+		return nil, &VersionNotExistsError{TfID: id, Version: version}
+	}
+	if err != nil {
+		logger.Warnf("Can't read version %d of state %s. With follow error %v", version, id, err)
+		return nil, err
+	}
+
+	return tfstate, nil
+}
+
+func (p *PostgresBackend) purge(tfID string) error {
+	var id = normalizeStateID(tfID)
+
+	result, err := p.db.Exec("DELETE FROM states WHERE id = $1", id)
+	if err != nil {
+		logger.Warnf("Can't delete state %s. Got follow error %v", id, err)
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		logger.Infof("State %s not found", id)
+	}
+	return nil
+}
+
+func (p *PostgresBackend) getLock(tfID string) (*LockInfo, error) {
+	var id = normalizeStateID(tfID)
+	var lock []byte
+	var lockInfo LockInfo
+
+	err := p.db.QueryRow("SELECT content FROM locks WHERE id = $1", id).Scan(&lock)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+		return nil, err
+	}
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	return &lockInfo, nil
+}
+
+func (p *PostgresBackend) lock(tfID string, lock []byte) ([]byte, error) {
+	var id = normalizeStateID(tfID)
+	var lockInfo LockInfo
+	var result []byte
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	err := p.transaction(id, func(tx *sql.Tx) error {
+		var currentLockID string
+		var currentLock []byte
+
+		err := tx.QueryRow("SELECT lock_id, content FROM locks WHERE id = $1", id).Scan(&currentLockID, &currentLock)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := tx.Exec(
+				`INSERT INTO locks (id, lock_id, operation, info, who, version, created, path, content)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				id, lockInfo.ID, lockInfo.Operation, lockInfo.Info, lockInfo.Who,
+				lockInfo.Version, lockInfo.Created, lockInfo.Path, lock,
+			); err != nil {
+				logger.Errorf("Can't write lock %s. Got follow error %v", id, err)
+				return err
+			}
+			result = lock
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+			return err
+		}
+		if currentLockID != lockInfo.ID {
+			var currentLockInfo LockInfo
+			_ = json.Unmarshal(currentLock, &currentLockInfo)
+			if !lockExpired(currentLockInfo, p.lockTTL, time.Now()) {
+				logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockID, lockInfo.ID)
+				return newLockConflictError(currentLockInfo)
+			}
+			if _, err := tx.Exec(
+				`UPDATE locks SET lock_id = $2, operation = $3, info = $4, who = $5, version = $6,
+				created = $7, path = $8, content = $9, locked_at = now() WHERE id = $1`,
+				id, lockInfo.ID, lockInfo.Operation, lockInfo.Info, lockInfo.Who,
+				lockInfo.Version, lockInfo.Created, lockInfo.Path, lock,
+			); err != nil {
+				logger.Errorf("Can't write lock %s. Got follow error %v", id, err)
+				return err
+			}
+			auditReclaimedLock(id, currentLockInfo, lockInfo.Who)
+			result = lock
+			return nil
+		}
+		if p.lockTTL > 0 {
+			now := time.Now().UTC()
+			renewed, err := renewLock(currentLock, now)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE locks SET created = $2, content = $3 WHERE id = $1", id, now, renewed); err != nil {
+				logger.Errorf("Can't write lock %s. Got follow error %v", id, err)
+				return err
+			}
+			currentLock = renewed
+		}
+		result = currentLock
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (p *PostgresBackend) locks() ([]HeldLock, error) {
+	var locks = []HeldLock{}
+
+	rows, err := p.db.Query("SELECT id, content FROM locks ORDER BY id")
+	if err != nil {
+		logger.Warnf("Can't read locks. With follow error %v", err)
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var held HeldLock
+		var lock []byte
+		if err := rows.Scan(&held.StateID, &lock); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(lock, &held.LockInfo); err != nil {
+			logger.Warnf("Ignore lock %s. Got follow error %v", held.StateID, err)
+			continue
+		}
+		locks = append(locks, held)
+	}
+
+	return locks, rows.Err()
+}
+
+func (p *PostgresBackend) states() ([]string, error) {
+	var states = []string{}
+
+	rows, err := p.db.Query("SELECT id FROM states ORDER BY id")
+	if err != nil {
+		logger.Warnf("Can't read states. With follow error %v", err)
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		states = append(states, id)
+	}
+
+	return states, rows.Err()
+}
+
+func (p *PostgresBackend) removeLock(tfID string, lockInfo LockInfo) error {
+	var id = normalizeStateID(tfID)
+
+	return p.transaction(id, func(tx *sql.Tx) error {
+		var currentLock []byte
+		var currentLockInfo LockInfo
+
+		err := tx.QueryRow("SELECT content FROM locks WHERE id = $1", id).Scan(&currentLock)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+			return err
+		}
+		if err := json.Unmarshal(currentLock, &currentLockInfo); err != nil {
+			logger.Errorf("unexpected decoding json error %v", err)
+			return err
+		}
+		if !sameLock(currentLockInfo, lockInfo) {
+			logger.Infof("lock %s changed while removing the lock", id)
+			return newLockConflictError(currentLockInfo)
+		}
+		if _, err := tx.Exec("DELETE FROM locks WHERE id = $1", id); err != nil {
+			logger.Warnf("Can't delete lock %s. Got follow error %v", id, err)
+			return err
+		}
+		return nil
+	})
+}
+
+func (p *PostgresBackend) unlock(tfID string, lock []byte) error {
+	var id = normalizeStateID(tfID)
+	var lockInfo LockInfo
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return err
+	}
+
+	return p.transaction(id, func(tx *sql.Tx) error {
+		var currentLockID string
+		var currentLock []byte
+
+		err := tx.QueryRow("SELECT lock_id, content FROM locks WHERE id = $1", id).Scan(&currentLockID, &currentLock)
+		if errors.Is(err, sql.ErrNoRows) {
+			logger.Infof("lock %s is deleted so notting to do.", id)
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+			return err
+		}
+		if currentLockID != lockInfo.ID {
+			var currentLockInfo LockInfo
+			_ = json.Unmarshal(currentLock, &currentLockInfo)
+			logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockID, lockInfo.ID)
+			return newLockConflictError(currentLockInfo)
+		}
+		if _, err := tx.Exec("DELETE FROM locks WHERE id = $1", id); err != nil {
+			logger.Warnf("Can't delete lock %s. Got follow error %v", id, err)
+			return err
+		}
+		return nil
+	})
+}
+
+// ping runs a write statement without changes, which fails for a read-only
+// database or missing privileges
+func (p *PostgresBackend) ping() error {
+	if err := p.db.Ping(); err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	_, err = tx.Exec("DELETE FROM locks WHERE false")
+
+	return err
+}
+
+// transaction runs fn in a transaction holding the advisory lock of the state id.
+// The transaction is committed if fn returns no error.
+func (p *PostgresBackend) transaction(id string, fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", postgresLockKey(id)); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// postgresLockKey maps a state id to the 64 bit key of its advisory lock
+func postgresLockKey(id string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("tfstate:" + id))
+	return int64(h.Sum64())
+}
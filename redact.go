@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// redactedValue replaces the masked values in the redacted view of a state
+const redactedValue = "(sensitive value)"
+
+// redactedView reports if the requesting user only gets the redacted view of the state, which is the
+// case for users allowed to read the state by the read_redacted permission only. Terraform clients
+// with the write permission get the exact state.
+func redactedView(r *http.Request, tfID string) bool {
+	return accessDenied(r, tfID, PermissionRead) != "" && accessDenied(r, tfID, PermissionWrite) != ""
+}
+
+// authorizeRedactedRead is a middleware refusing requests for a state with 403 if the requesting
+// user has neither the read nor the read_redacted permission on the state. The missing read
+// permission is reported as reason.
+func authorizeRedactedRead(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tfID := chi.URLParam(r, "id")
+		if accessDenied(r, tfID, PermissionReadRedacted) != "" {
+			writeForbidden(w, accessDenied(r, tfID, PermissionRead))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRedactable writes the state, which is redacted if the requesting user only gets the redacted view
+func writeRedactable(w http.ResponseWriter, r *http.Request, tfID string, tfstate []byte) {
+	if redactedView(r, tfID) {
+		redacted, err := redactTfstate(tfstate, config.redactAttributes)
+		if err != nil {
+			logger.Warnf("Can not redact state %s: %v", tfID, err)
+			writeStatus(w, http.StatusInternalServerError)
+			return
+		}
+		tfstate = redacted
+	}
+	_, _ = w.Write(tfstate)
+}
+
+// redactTfstate masks the values of the sensitive outputs, the sensitive attributes of the resource
+// instances and the attributes with a name matching one of the patterns like "*password*"
+func redactTfstate(tfstate []byte, patterns []string) ([]byte, error) {
+	var state map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(tfstate))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state); err != nil {
+		return nil, fmt.Errorf("can't parse state: %w", err)
+	}
+
+	redactOutputs(state["outputs"])
+	resources, _ := state["resources"].([]interface{})
+	for _, resource := range resources {
+		r, _ := resource.(map[string]interface{})
+		instances, _ := r["instances"].([]interface{})
+		for _, instance := range instances {
+			if i, ok := instance.(map[string]interface{}); ok {
+				redactInstance(i, patterns)
+			}
+		}
+	}
+	// a version 3 state has the outputs and resources in the modules
+	modules, _ := state["modules"].([]interface{})
+	for _, module := range modules {
+		m, _ := module.(map[string]interface{})
+		redactOutputs(m["outputs"])
+		resources, _ := m["resources"].(map[string]interface{})
+		for _, resource := range resources {
+			r, _ := resource.(map[string]interface{})
+			primary, _ := r["primary"].(map[string]interface{})
+			redactFlatAttributes(primary["attributes"], patterns)
+		}
+	}
+
+	return json.MarshalIndent(state, "", "  ")
+}
+
+func redactOutputs(outputs interface{}) {
+	o, _ := outputs.(map[string]interface{})
+	for _, output := range o {
+		if value, ok := output.(map[string]interface{}); ok && value["sensitive"] == true {
+			value["value"] = redactedValue
+		}
+	}
+}
+
+// redactInstance masks the attributes of a resource instance listed in its sensitive_attributes
+// like [[{"type": "get_attr", "value": "password"}]] and matching the patterns. All attributes
+// are masked if a sensitive attribute can't be resolved.
+func redactInstance(instance map[string]interface{}, patterns []string) {
+	sensitive, _ := instance["sensitive_attributes"].([]interface{})
+	for _, sensitivePath := range sensitive {
+		steps, ok := sensitivePath.([]interface{})
+		if !ok || !redactPath(instance["attributes"], steps) {
+			instance["attributes"] = redactedValue
+			return
+		}
+	}
+	redactMatchingAttributes(instance["attributes"], patterns)
+	redactFlatAttributes(instance["attributes_flat"], patterns)
+}
+
+// redactPath masks the value at the path of steps like {"type": "index", "value": 0}.
+// It reports false if the path can't be resolved.
+func redactPath(value interface{}, steps []interface{}) bool {
+	if len(steps) == 0 {
+		return false
+	}
+	step, ok := steps[0].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	switch container := value.(type) {
+	case map[string]interface{}:
+		key, ok := step["value"].(string)
+		if !ok {
+			return false
+		}
+		if child, exists := container[key]; exists {
+			if !redactChild(child, steps[1:]) {
+				container[key] = redactedValue
+			}
+		}
+		return true
+	case []interface{}:
+		number, ok := step["value"].(json.Number)
+		if !ok {
+			return false
+		}
+		index, err := number.Int64()
+		if err != nil {
+			return false
+		}
+		if index >= 0 && index < int64(len(container)) && !redactChild(container[index], steps[1:]) {
+			container[index] = redactedValue
+		}
+		return true
+	case nil:
+		return true
+	}
+
+	return false
+}
+
+// redactChild masks the remaining steps within a child value, it reports false if the
+// child itself has to be masked
+func redactChild(child interface{}, steps []interface{}) bool {
+	switch child.(type) {
+	case map[string]interface{}, []interface{}:
+		return len(steps) > 0 && redactPath(child, steps)
+	}
+	return false
+}
+
+// redactMatchingAttributes masks the values of the object keys matching one of the patterns
+func redactMatchingAttributes(value interface{}, patterns []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if matchesAttributePattern(name, patterns) {
+				v[name] = redactedValue
+				continue
+			}
+			redactMatchingAttributes(child, patterns)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactMatchingAttributes(child, patterns)
+		}
+	}
+}
+
+// redactFlatAttributes masks the flattened attributes like "tags.password" of which the
+// last segment matches one of the patterns
+func redactFlatAttributes(value interface{}, patterns []string) {
+	attributes, _ := value.(map[string]interface{})
+	for name := range attributes {
+		if matchesAttributePattern(name[strings.LastIndex(name, ".")+1:], patterns) {
+			attributes[name] = redactedValue
+		}
+	}
+}
+
+// matchesAttributePattern matches the attribute name case insensitive against the patterns
+func matchesAttributePattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSensitiveTfstate = `{"version": 4, "terraform_version": "1.5.7", "serial": 12345678901234567890, "lineage": "a1",
+  "outputs": {
+    "endpoint": {"value": "db.example.com", "type": "string"},
+    "password": {"value": "hunter2", "type": "string", "sensitive": true}
+  },
+  "resources": [
+    {"mode": "managed", "type": "aws_db_instance", "name": "main", "instances": [{
+      "attributes": {"id": "db-1", "port": 5432, "password": "hunter2", "connection": {"host": "db", "user": "admin"},
+        "users": [{"name": "app", "login": "app-login"}, {"name": "ro", "login": "ro-login"}], "tags": {"Name": "main", "api_token": "t0k3n"}},
+      "sensitive_attributes": [[{"type": "get_attr", "value": "connection"}, {"type": "get_attr", "value": "user"}], [{"type": "get_attr", "value": "users"}, {"type": "index", "value": 1}, {"type": "get_attr", "value": "login"}]]
+    }]},
+    {"mode": "managed", "type": "null_resource", "name": "unknown_path", "instances": [{
+      "attributes": {"id": "1"},
+      "sensitive_attributes": [{"type": "get_attr", "value": "id"}]
+    }]}
+  ]}`
+
+func Test_redactTfstate(t *testing.T) {
+	var state map[string]interface{}
+
+	redacted, err := redactTfstate([]byte(testSensitiveTfstate), []string{"*password*", "*TOKEN*"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(redacted), `"serial": 12345678901234567890`)
+	assert.Nil(t, json.Unmarshal(redacted, &state))
+
+	outputs := state["outputs"].(map[string]interface{})
+	assert.Equal(t, "db.example.com", outputs["endpoint"].(map[string]interface{})["value"])
+	assert.Equal(t, redactedValue, outputs["password"].(map[string]interface{})["value"])
+
+	resources := state["resources"].([]interface{})
+	db := resources[0].(map[string]interface{})["instances"].([]interface{})[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "db-1", db["id"])
+	assert.Equal(t, float64(5432), db["port"])
+	assert.Equal(t, redactedValue, db["password"])
+	assert.Equal(t, map[string]interface{}{"host": "db", "user": redactedValue}, db["connection"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "app", "login": "app-login"},
+		map[string]interface{}{"name": "ro", "login": redactedValue},
+	}, db["users"])
+	assert.Equal(t, map[string]interface{}{"Name": "main", "api_token": redactedValue}, db["tags"])
+	unknownPath := resources[1].(map[string]interface{})["instances"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, redactedValue, unknownPath["attributes"])
+
+	redacted, err = redactTfstate([]byte(`{"version": 3, "serial": 1, "modules": [{"path": ["root"],
+	  "outputs": {"password": {"sensitive": true, "type": "string", "value": "hunter2"}},
+	  "resources": {"aws_db_instance.main": {"type": "aws_db_instance", "primary": {"attributes": {"id": "db-1", "password": "hunter2", "tags.api_token": "t0k3n"}}}}
+	}]}`), []string{"*password*", "*token*"})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(redacted), "hunter2")
+	assert.NotContains(t, string(redacted), "t0k3n")
+	assert.Contains(t, string(redacted), `"id": "db-1"`)
+
+	_, err = redactTfstate([]byte("<html>"), nil)
+	assert.Error(t, err)
+}
+
+func Test_getTfstate_redacted(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "acl.yaml", testACLPolicy)
+	createDirectoryFile(tmpTestDir, "team-a/project", "env.tfstate", testSensitiveTfstate)
+	createDirectoryFile(tmpTestDir, ".versions/team-a/project/env", "1-1637940915-1.tfstate", testSensitiveTfstate)
+	accessPolicy, _ = loadACLPolicy(tmpTestDir + "acl.yaml")
+	defer func(redactAttributes []string) {
+		accessPolicy = nil
+		config.redactAttributes = redactAttributes
+	}(config.redactAttributes)
+	config.redactAttributes = []string{"*password*"}
+
+	tests := []struct {
+		name         string
+		username     string
+		suburl       string
+		wantStatus   int
+		wantRedacted bool
+	}{
+		{"reader", "carol", "/team-a/project/env", 200, false},
+		{"writer", "alice", "/team-a/project/env", 200, false},
+		{"restricted", "frank", "/team-a/project/env", 200, true},
+		{"restricted version", "frank", "/team-a/project/env/versions/1", 200, true},
+		{"restricted diff", "frank", "/team-a/project/env/diff?from=1", 403, false},
+		{"restricted other team", "frank", "/team-b/project/prod", 403, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			router := chi.NewRouter()
+			router.Use(authenticate("restricted access", newStaticAuthenticator(map[string]string{"alice": "secret", "carol": "secret", "frank": "secret"})))
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, "GET", tt.suburl, nil, tt.username, "secret")
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			if tt.wantStatus != 200 {
+				return
+			}
+			if tt.wantRedacted {
+				assert.NotContains(t, got, "hunter2")
+				assert.Contains(t, got, redactedValue)
+			} else {
+				assert.Equal(t, testSensitiveTfstate, got)
+			}
+		})
+	}
+	hooks.Reset()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// StateResource describes a resource managed by a terraform state
+type StateResource struct {
+	State     string `json:"state,omitempty"`
+	Address   string `json:"address"`
+	Module    string `json:"module,omitempty"`
+	Mode      string `json:"mode"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+	Instances int    `json:"instances"`
+}
+
+// ResourceFilter selects resources by type and module address, an empty field matches every resource.
+// The module "root" selects the resources of the root module.
+type ResourceFilter struct {
+	Type   string
+	Module string
+}
+
+func newResourceFilter(r *http.Request) ResourceFilter {
+	return ResourceFilter{Type: r.URL.Query().Get("type"), Module: r.URL.Query().Get("module")}
+}
+
+func (f ResourceFilter) matches(resource StateResource) bool {
+	if f.Type != "" && f.Type != resource.Type {
+		return false
+	}
+	switch f.Module {
+	case "":
+		return true
+	case "root":
+		return resource.Module == ""
+	}
+	return f.Module == resource.Module
+}
+
+// stateResources returns the resources of a state of version 4 or 3 in the order of their address
+func stateResources(tfstate []byte) ([]StateResource, error) {
+	var state struct {
+		Version   int `json:"version"`
+		Resources []struct {
+			Module    string            `json:"module"`
+			Mode      string            `json:"mode"`
+			Type      string            `json:"type"`
+			Name      string            `json:"name"`
+			Provider  string            `json:"provider"`
+			Instances []json.RawMessage `json:"instances"`
+		} `json:"resources"`
+		Modules []struct {
+			Path      []string `json:"path"`
+			Resources map[string]struct {
+				Type     string `json:"type"`
+				Provider string `json:"provider"`
+			} `json:"resources"`
+		} `json:"modules"`
+	}
+	var resources = []StateResource{}
+
+	if err := json.Unmarshal(tfstate, &state); err != nil {
+		return nil, fmt.Errorf("can't parse state: %w", err)
+	}
+	switch state.Version {
+	case 4:
+		for _, r := range state.Resources {
+			resources = append(resources, newStateResource(r.Module, r.Mode, r.Type, r.Name, r.Provider, len(r.Instances)))
+		}
+	case 3:
+		// a version 3 state has a resource per instance with keys like "aws_instance.web.0"
+		for _, module := range state.Modules {
+			var byAddress = make(map[string]*StateResource)
+
+			for key, r := range module.Resources {
+				resource, _, ok := parseLegacyResourceKey(legacyModuleAddress(module.Path), key)
+				if !ok {
+					continue
+				}
+				resource.Provider = r.Provider
+				if existing, ok := byAddress[resource.Address]; ok {
+					existing.Instances++
+					continue
+				}
+				resource.Instances = 1
+				byAddress[resource.Address] = &resource
+			}
+			for _, resource := range byAddress {
+				resources = append(resources, *resource)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Address < resources[j].Address
+	})
+
+	return resources, nil
+}
+
+// newStateResource creates the resource with its address like "module.vpc.data.aws_ami.ubuntu"
+func newStateResource(module string, mode string, resourceType string, name string, provider string, instances int) StateResource {
+	var address = resourceType + "." + name
+
+	if mode == "data" {
+		address = "data." + address
+	}
+	if module != "" {
+		address = module + "." + address
+	}
+
+	return StateResource{
+		Address:   address,
+		Module:    module,
+		Mode:      mode,
+		Type:      resourceType,
+		Name:      name,
+		Provider:  provider,
+		Instances: instances,
+	}
+}
+
+// legacyModuleAddress returns the address like "module.vpc" of a module path like ["root", "vpc"]
+// of a version 3 state
+func legacyModuleAddress(path []string) string {
+	var address []string
+
+	for i, name := range path {
+		if i > 0 {
+			address = append(address, "module."+name)
+		}
+	}
+
+	return strings.Join(address, ".")
+}
+
+// parseLegacyResourceKey parses the key of a resource instance of a version 3 state like
+// "data.aws_ami.ubuntu" or "aws_instance.web.0" into the resource and the instance index
+func parseLegacyResourceKey(module string, key string) (StateResource, string, bool) {
+	var mode = "managed"
+
+	if strings.HasPrefix(key, "data.") {
+		mode = "data"
+		key = strings.TrimPrefix(key, "data.")
+	}
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) < 2 {
+		return StateResource{}, "", false
+	}
+	resource := newStateResource(module, mode, parts[0], parts[1], "", 0)
+	if len(parts) == 3 {
+		return resource, parts[2], true
+	}
+
+	return resource, "", true
+}
+
+// filterResources returns the resources matching the filter
+func filterResources(resources []StateResource, filter ResourceFilter) []StateResource {
+	var filtered = []StateResource{}
+
+	for _, resource := range resources {
+		if filter.matches(resource) {
+			filtered = append(filtered, resource)
+		}
+	}
+
+	return filtered
+}
+
+func getTfstateResources(w http.ResponseWriter, r *http.Request) {
+	tfID := chi.URLParam(r, "id")
+	current, err := currentState(storageBackend, tfID)
+	if err != nil {
+		logger.Warnf("Can not read state %s: %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if current == nil {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+	resources, err := stateResources(current)
+	if err != nil {
+		logger.Warnf("Can not read resources of state %s: %v", tfID, err)
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	body, _ := json.Marshal(filterResources(resources, newResourceFilter(r)))
+	_, _ = w.Write(body)
+}
+
+// listResources returns the matching resources of all states the user is allowed to read.
+// States which can't be read or parsed are skipped.
+func listResources(w http.ResponseWriter, r *http.Request) {
+	var filter = newResourceFilter(r)
+	var resources = []StateResource{}
+
+	states, err := storageBackend.states()
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(states)
+	for _, tfID := range states {
+		if accessDenied(r, tfID, PermissionRead) != "" {
+			continue
+		}
+		current, err := currentState(storageBackend, tfID)
+		if err != nil || current == nil {
+			continue
+		}
+		found, err := stateResources(current)
+		if err != nil {
+			logger.Infof("Skip resources of state %s: %v", tfID, err)
+			continue
+		}
+		for _, resource := range filterResources(found, filter) {
+			resource.State = tfID
+			resources = append(resources, resource)
+		}
+	}
+	body, _ := json.Marshal(resources)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testResourcesTfstate = `{"version": 4, "terraform_version": "1.5.7", "serial": 3, "lineage": "a1", "outputs": {}, "resources": [
+  {"mode": "managed", "type": "aws_instance", "name": "web", "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]", "instances": [{"index_key": 0}, {"index_key": 1}]},
+  {"mode": "data", "type": "aws_ami", "name": "ubuntu", "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]", "instances": [{}]},
+  {"module": "module.vpc", "mode": "managed", "type": "aws_vpc", "name": "main", "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]", "instances": [{}]}
+]}`
+
+func testResourceAddresses(resources []StateResource) []string {
+	var addresses = []string{}
+
+	for _, resource := range resources {
+		addresses = append(addresses, resource.State+":"+resource.Address)
+	}
+
+	return addresses
+}
+
+func Test_stateResources(t *testing.T) {
+	resources, err := stateResources([]byte(testResourcesTfstate))
+	assert.Nil(t, err)
+	assert.Equal(t, []StateResource{
+		{Address: "aws_instance.web", Mode: "managed", Type: "aws_instance", Name: "web", Provider: `provider["registry.terraform.io/hashicorp/aws"]`, Instances: 2},
+		{Address: "data.aws_ami.ubuntu", Mode: "data", Type: "aws_ami", Name: "ubuntu", Provider: `provider["registry.terraform.io/hashicorp/aws"]`, Instances: 1},
+		{Address: "module.vpc.aws_vpc.main", Module: "module.vpc", Mode: "managed", Type: "aws_vpc", Name: "main", Provider: `provider["registry.terraform.io/hashicorp/aws"]`, Instances: 1},
+	}, resources)
+
+	resources, err = stateResources([]byte(`{"version": 3, "serial": 1, "modules": [
+	  {"path": ["root"], "resources": {"aws_instance.web.0": {"type": "aws_instance", "provider": "provider.aws"}, "aws_instance.web.1": {"type": "aws_instance", "provider": "provider.aws"}, "data.aws_ami.ubuntu": {"type": "aws_ami", "provider": "provider.aws"}}},
+	  {"path": ["root", "vpc"], "resources": {"aws_vpc.main": {"type": "aws_vpc", "provider": "provider.aws"}}}
+	]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []StateResource{
+		{Address: "aws_instance.web", Mode: "managed", Type: "aws_instance", Name: "web", Provider: "provider.aws", Instances: 2},
+		{Address: "data.aws_ami.ubuntu", Mode: "data", Type: "aws_ami", Name: "ubuntu", Provider: "provider.aws", Instances: 1},
+		{Address: "module.vpc.aws_vpc.main", Module: "module.vpc", Mode: "managed", Type: "aws_vpc", Name: "main", Provider: "provider.aws", Instances: 1},
+	}, resources)
+
+	resources, err = stateResources([]byte(testTfstate(1, "a1")))
+	assert.Nil(t, err)
+	assert.Empty(t, resources)
+
+	_, err = stateResources([]byte(`{"version": 5}`))
+	assert.EqualError(t, err, "unsupported state version 5")
+}
+
+func Test_getTfstateResources(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createDirectoryFile(tmpTestDir, "team", "web.tfstate", testResourcesTfstate)
+
+	tests := []struct {
+		name       string
+		suburl     string
+		wantStatus int
+		want       []string
+	}{
+		{"all resources", "/team/web/resources", 200, []string{":aws_instance.web", ":data.aws_ami.ubuntu", ":module.vpc.aws_vpc.main"}},
+		{"by type", "/team/web/resources?type=aws_instance", 200, []string{":aws_instance.web"}},
+		{"by module", "/team/web/resources?module=module.vpc", 200, []string{":module.vpc.aws_vpc.main"}},
+		{"root module", "/team/web/resources?module=root", 200, []string{":aws_instance.web", ":data.aws_ami.ubuntu"}},
+		{"no match", "/team/web/resources?type=aws_s3_bucket", 200, []string{}},
+		{"unknown state", "/team/missing/resources", 404, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			router := chi.NewRouter()
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, "GET", tt.suburl, nil)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			if tt.want != nil {
+				var resources []StateResource
+				assert.Nil(t, json.Unmarshal([]byte(got), &resources))
+				assert.Equal(t, tt.want, testResourceAddresses(resources))
+			}
+		})
+	}
+	hooks.Reset()
+}
+
+func Test_listResources(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "acl.yaml", testACLPolicy)
+	createDirectoryFile(tmpTestDir, "team-a/web", "prod.tfstate", testResourcesTfstate)
+	createDirectoryFile(tmpTestDir, "team-b/web", "prod.tfstate", testResourcesTfstate)
+	createDirectoryFile(tmpTestDir, "team-b", "broken.tfstate", "<html>")
+	policy, _ := loadACLPolicy(tmpTestDir + "acl.yaml")
+	defer func() {
+		accessPolicy = nil
+	}()
+
+	tests := []struct {
+		name     string
+		policy   *ACLPolicy
+		username string
+		query    string
+		want     []string
+	}{
+		{"without policy", nil, "alice", "?type=aws_instance", []string{"team-a/web/prod:aws_instance.web", "team-b/web/prod:aws_instance.web"}},
+		{"readable states", policy, "alice", "?type=aws_instance", []string{"team-a/web/prod:aws_instance.web"}},
+		{"by module", policy, "carol", "?module=module.vpc", []string{"team-a/web/prod:module.vpc.aws_vpc.main", "team-b/web/prod:module.vpc.aws_vpc.main"}},
+		{"outputs only", policy, "erin", "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			accessPolicy = tt.policy
+			router := chi.NewRouter()
+			router.Use(authenticate("restricted access", newStaticAuthenticator(map[string]string{"alice": "secret", "carol": "secret", "erin": "secret"})))
+			router.Get("/resources", listResources)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, "GET", "/resources"+tt.query, nil, tt.username, "secret")
+			assert.Equal(t, 200, rr.StatusCode)
+			var resources []StateResource
+			assert.Nil(t, json.Unmarshal([]byte(got), &resources))
+			assert.Equal(t, tt.want, testResourceAddresses(resources))
+			assert.NotContains(t, got, "broken")
+		})
+	}
+	hooks.Reset()
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3LockRetries = 3
+
+// S3Error is returned if the object storage answers with an unexpected status
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3 status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// S3Backend is the "s3" storage driver storing the states and locks as objects
+// in a bucket of a S3 compatible object storage like AWS S3 or MinIO.
+// Locks are created with a conditional write (If-None-Match: *), so only one
+// request can ever create the lock object even with multiple server replicas.
+type S3Backend struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	retention HistoryRetention
+	lockTTL   time.Duration
+	now       func() time.Time
+}
+
+func init() {
+	RegisterStorageDriver("s3", newS3Backend)
+}
+
+func newS3Backend(c *Config) (StateStore, error) {
+	endpoint, err := url.Parse(c.s3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %s: %w", c.s3Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q, expected a url like https://s3.amazonaws.com", c.s3Endpoint)
+	}
+	if c.s3Bucket == "" {
+		return nil, errors.New("no s3 bucket configured")
+	}
+
+	return &S3Backend{
+		client:    &http.Client{Timeout: 30 * time.Second},
+		endpoint:  endpoint,
+		bucket:    c.s3Bucket,
+		prefix:    strings.Trim(c.s3Prefix, "/"),
+		region:    c.s3Region,
+		accessKey: c.s3AccessKey,
+		secretKey: c.s3SecretKey,
+		pathStyle: c.s3PathStyle,
+		retention: c.getHistoryRetention(),
+		lockTTL:   c.lockTTL,
+		now:       time.Now,
+	}, nil
+}
+
+// s3Object is an entry of the ListObjectsV2 result
+type s3Object struct {
+	Key  string
+	Size int64
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Backend) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *S3Backend) objectKey(tfID string, extension string) string {
+	return s.key(normalizeStateID(tfID) + extension)
+}
+
+func (s *S3Backend) versionPrefix(tfID string) string {
+	return s.key(".versions/" + normalizeStateID(tfID) + "/")
+}
+
+func (s *S3Backend) get(tfID string) ([]byte, error) {
+	var key = s.objectKey(tfID, ".tfstate")
+
+	tfstate, _, err := s.getObject(key)
+	if err != nil {
+		var notExists *FileNotExistsError
+		if errors.As(err, &notExists) {
+			logger.Infof("Object %s not found", key)
+		} else {
+			logger.Warnf("Can't read object %s. With follow error %v", key, err)
+		}
+		return nil, err
+	}
+
+	return tfstate, nil
+}
+
+func (s *S3Backend) update(tfID string, tfstate []byte) error {
+	var key = s.objectKey(tfID, ".tfstate")
+
+	if err := s.archive(tfID, tfstate); err != nil {
+		return err
+	}
+	if err := s.putObject(key, tfstate, nil); err != nil {
+		logger.Warnf("Can't write object %s. Got follow error %v", key, err)
+		return err
+	}
+	s.prune(tfID)
+
+	return nil
+}
+
+// archive keeps the current state as new version if it will be replaced by different content
+func (s *S3Backend) archive(tfID string, tfstate []byte) error {
+	var key = s.objectKey(tfID, ".tfstate")
+	var notExists *FileNotExistsError
+
+	current, _, err := s.getObject(key)
+	if errors.As(err, &notExists) || (err == nil && bytes.Equal(current, tfstate)) {
+		return nil
+	}
+	if err != nil {
+		logger.Warnf("Can't read object %s. With follow error %v", key, err)
+		return err
+	}
+
+	versions, err := s.versions(tfID)
+	if err != nil {
+		return err
+	}
+	versionKey := s.versionPrefix(tfID) + versionFileName(newStateVersion(versions, current, s.now()))
+	if err := s.putObject(versionKey, current, nil); err != nil {
+		logger.Warnf("Can't write object %s. Got follow error %v", versionKey, err)
+		return err
+	}
+
+	return nil
+}
+
+// prune removes the versions outside of the history retention
+func (s *S3Backend) prune(tfID string) {
+	versions, err := s.versions(tfID)
+	if err != nil {
+		return
+	}
+	for _, version := range s.retention.expired(versions, s.now()) {
+		versionKey := s.versionPrefix(tfID) + versionFileName(version)
+		if err := s.deleteObject(versionKey, nil); err != nil {
+			logger.Warnf("Can't delete object %s. Got follow error %v", versionKey, err)
+		}
+	}
+}
+
+func (s *S3Backend) versions(tfID string) ([]StateVersion, error) {
+	var versionPrefix = s.versionPrefix(tfID)
+	var versions = []StateVersion{}
+
+	objects, err := s.listObjects(versionPrefix)
+	if err != nil {
+		logger.Warnf("Can't list objects %s. With follow error %v", versionPrefix, err)
+		return nil, err
+	}
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, versionPrefix)
+		if version, ok := parseVersionFileName(name, object.Size); ok {
+			versions = append(versions, version)
+		}
+	}
+	sortVersions(versions)
+
+	return versions, nil
+}
+
+func (s *S3Backend) getVersion(tfID string, version int) ([]byte, error) {
+	versions, err := s.versions(tfID)
+	if err != nil {
+		return nil, err
+	}
+	for _, stateVersion := range versions {
+		if stateVersion.Version == version {
+			versionKey := s.versionPrefix(tfID) + versionFileName(stateVersion)
+			tfstate, _, err := s.getObject(versionKey)
+			if err != nil {
+				logger.Warnf("Can't read object %s. With follow error %v", versionKey, err)
+				return nil, err
+			}
+			return tfstate, nil
+		}
+	}
+
+	logger.Infof("Version %d of state %s not found", version, tfID)
+	return nil, &VersionNotExistsError{TfID: tfID, Version: version}
+}
+
+func (s *S3Backend) purge(tfID string) error {
+	var key = s.objectKey(tfID, ".tfstate")
+
+	if err := s.deleteObject(key, nil); err != nil {
+		var notExists *FileNotExistsError
+		if errors.As(err, &notExists) {
+			logger.Infof("Object %s not found", key)
+			return nil
+		}
+		logger.Warnf("Can't delete object %s. Got follow error %v", key, err)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Backend) getLock(tfID string) (*LockInfo, error) {
+	var key = s.objectKey(tfID, ".lock")
+	var lockInfo LockInfo
+	var notExists *FileNotExistsError
+
+	lock, _, err := s.getObject(key)
+	if errors.As(err, &notExists) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("Can't read lock object %s. With follow error %v", key, err)
+		return nil, err
+	}
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	return &lockInfo, nil
+}
+
+func (s *S3Backend) lock(tfID string, lock []byte) ([]byte, error) {
+	var key = s.objectKey(tfID, ".lock")
+	var lockInfo, currentLockInfo LockInfo
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	for i := 0; i < s3LockRetries; i++ {
+		err := s.putObject(key, lock, http.Header{"If-None-Match": []string{"*"}})
+		if err == nil {
+			return lock, nil
+		}
+		if !isS3PreconditionFailed(err) {
+			logger.Errorf("Can't write lock object %s. Got follow error %v", key, err)
+			return nil, err
+		}
+
+		currentLock, etag, err := s.getObject(key)
+		if err != nil {
+			var notExists *FileNotExistsError
+			if errors.As(err, &notExists) {
+				// lock was released between the write and the read, try again
+				continue
+			}
+			logger.Errorf("Can't read lock object %s. With follow error %v", key, err)
+			return nil, err
+		}
+		if err := json.Unmarshal(currentLock, &currentLockInfo); err != nil {
+			logger.Errorf("unexpected decoding json error %v", err)
+			return nil, err
+		}
+		// replacing an expired or renewing the own lock is only done if the lock object is unchanged
+		ifMatch := http.Header{"If-Match": []string{etag}}
+		if currentLockInfo.ID != lockInfo.ID {
+			if !lockExpired(currentLockInfo, s.lockTTL, s.now()) {
+				logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockInfo.ID, lockInfo.ID)
+				return nil, newLockConflictError(currentLockInfo)
+			}
+			if err := s.putObject(key, lock, ifMatch); err != nil {
+				if isS3PreconditionFailed(err) {
+					continue
+				}
+				logger.Errorf("Can't write lock object %s. Got follow error %v", key, err)
+				return nil, err
+			}
+			auditReclaimedLock(tfID, currentLockInfo, lockInfo.Who)
+			return lock, nil
+		}
+		if s.lockTTL > 0 {
+			renewed, err := renewLock(currentLock, s.now())
+			if err != nil {
+				return nil, err
+			}
+			if err := s.putObject(key, renewed, ifMatch); err != nil {
+				if isS3PreconditionFailed(err) {
+					continue
+				}
+				logger.Errorf("Can't write lock object %s. Got follow error %v", key, err)
+				return nil, err
+			}
+			return renewed, nil
+		}
+		return currentLock, nil
+	}
+
+	logger.Errorf("Can't acquire lock object %s after %d retries", key, s3LockRetries)
+	return nil, &ConflictError{
+		StatusCode: http.StatusConflict,
+	}
+}
+
+func (s *S3Backend) locks() ([]HeldLock, error) {
+	var locks = []HeldLock{}
+	var statePrefix = s.key("")
+
+	objects, err := s.listObjects(statePrefix)
+	if err != nil {
+		logger.Warnf("Can't list objects %s. With follow error %v", statePrefix, err)
+		return nil, err
+	}
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, statePrefix)
+		if !strings.HasSuffix(name, ".lock") || strings.HasPrefix(name, ".versions/") {
+			continue
+		}
+		lock, _, err := s.getObject(object.Key)
+		if err != nil {
+			// lock was released after listing
+			continue
+		}
+		held := HeldLock{StateID: strings.TrimSuffix(name, ".lock")}
+		if err := json.Unmarshal(lock, &held.LockInfo); err != nil {
+			logger.Warnf("Ignore lock object %s. Got follow error %v", object.Key, err)
+			continue
+		}
+		locks = append(locks, held)
+	}
+
+	return locks, nil
+}
+
+func (s *S3Backend) states() ([]string, error) {
+	var states = []string{}
+	var statePrefix = s.key("")
+
+	objects, err := s.listObjects(statePrefix)
+	if err != nil {
+		logger.Warnf("Can't list objects %s. With follow error %v", statePrefix, err)
+		return nil, err
+	}
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, statePrefix)
+		if !strings.HasSuffix(name, ".tfstate") || strings.HasPrefix(name, ".versions/") {
+			continue
+		}
+		states = append(states, strings.TrimSuffix(name, ".tfstate"))
+	}
+
+	return states, nil
+}
+
+func (s *S3Backend) removeLock(tfID string, lockInfo LockInfo) error {
+	var key = s.objectKey(tfID, ".lock")
+	var currentLockInfo LockInfo
+	var notExists *FileNotExistsError
+
+	currentLock, etag, err := s.getObject(key)
+	if errors.As(err, &notExists) {
+		return nil
+	}
+	if err != nil {
+		logger.Errorf("Can't read lock object %s. With follow error %v", key, err)
+		return err
+	}
+	if err := json.Unmarshal(currentLock, &currentLockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return err
+	}
+	if !sameLock(currentLockInfo, lockInfo) {
+		logger.Infof("lock object %s changed while removing the lock", key)
+		return newLockConflictError(currentLockInfo)
+	}
+	// only delete the lock we have compared, a renewal creates a new etag
+	if err := s.deleteObject(key, http.Header{"If-Match": []string{etag}}); err != nil {
+		if isS3PreconditionFailed(err) {
+			logger.Infof("lock object %s changed while removing the lock", key)
+			return &ConflictError{
+				StatusCode: http.StatusConflict,
+			}
+		}
+		if errors.As(err, &notExists) {
+			return nil
+		}
+		logger.Warnf("Can't delete lock object %s. Got follow error %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3Backend) unlock(tfID string, lock []byte) error {
+	var key = s.objectKey(tfID, ".lock")
+	var lockInfo, currentLockInfo LockInfo
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return err
+	}
+	currentLock, etag, err := s.getObject(key)
+	if err != nil {
+		var notExists *FileNotExistsError
+		if errors.As(err, &notExists) {
+			logger.Infof("lock object %s is deleted so notting to do.", key)
+			return nil
+		}
+		logger.Errorf("Can't read lock object %s. With follow error %v", key, err)
+		return err
+	}
+	if err := json.Unmarshal(currentLock, &currentLockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return err
+	}
+	if currentLockInfo.ID != lockInfo.ID {
+		logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockInfo.ID, lockInfo.ID)
+		return newLockConflictError(currentLockInfo)
+	}
+	// only delete the lock we have read, a concurrent relock creates a new etag
+	if err := s.deleteObject(key, http.Header{"If-Match": []string{etag}}); err != nil {
+		if isS3PreconditionFailed(err) {
+			logger.Infof("lock object %s changed while unlocking", key)
+			return &ConflictError{
+				StatusCode: http.StatusConflict,
+			}
+		}
+		var notExists *FileNotExistsError
+		if errors.As(err, &notExists) {
+			return nil
+		}
+		logger.Warnf("Can't delete lock object %s. Got follow error %v", key, err)
+		return err
+	}
+
+	return nil
+}
+
+// ping writes and removes a health check object, which can't collide with a state
+// because a state id can't start with a dot
+func (s *S3Backend) ping() error {
+	var key = s.key(".healthcheck")
+
+	if err := s.putObject(key, []byte("ok"), nil); err != nil {
+		return err
+	}
+	return s.deleteObject(key, nil)
+}
+
+func (s *S3Backend) getObject(key string) ([]byte, string, error) {
+	resp, body, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+func (s *S3Backend) putObject(key string, content []byte, header http.Header) error {
+	_, _, err := s.do(http.MethodPut, key, nil, content, header)
+	return err
+}
+
+func (s *S3Backend) deleteObject(key string, header http.Header) error {
+	_, _, err := s.do(http.MethodDelete, key, nil, nil, header)
+	return err
+}
+
+func (s *S3Backend) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		u.Path = basePath + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+	u.RawPath = s3URIEncode(u.Path, false)
+	return &u
+}
+
+// listObjects returns all objects with the given key prefix
+func (s *S3Backend) listObjects(keyPrefix string) ([]s3Object, error) {
+	var objects []s3Object
+	var query = url.Values{"list-type": []string{"2"}, "prefix": []string{keyPrefix}}
+
+	for {
+		var result s3ListBucketResult
+		_, body, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3Backend) do(method string, key string, query url.Values, content []byte, header http.Header) (*http.Response, []byte, error) {
+	objectURL := s.objectURL(key)
+	objectURL.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, objectURL.String(), bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if content != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	s.sign(req, content)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp, nil, &FileNotExistsError{Info: fmt.Sprintf("object %s not found", key)}
+	}
+	if resp.StatusCode >= 300 {
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		_ = xml.Unmarshal(body, s3Err)
+		return resp, nil, s3Err
+	}
+
+	return resp, body, nil
+}
+
+// sign adds an AWS signature version 4 authorization header to the request.
+// All headers set on the request are part of the signature.
+func (s *S3Backend) sign(req *http.Request, payload []byte) {
+	var now = s.now().UTC()
+	var amzDate = now.Format("20060102T150405Z")
+	var date = now.Format("20060102")
+	var payloadHash = sha256.Sum256(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// s3URIEncode encodes all characters except the unreserved ones like described in
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func s3URIEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+
+	return encoded.String()
+}
+
+func isS3PreconditionFailed(err error) bool {
+	var s3Err *S3Error
+	return errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusPreconditionFailed
+}
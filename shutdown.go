@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set as soon as the server starts to drain the requests
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// refuseLocksWhileShuttingDown is a middleware refusing new locks with 503 during the shutdown,
+// so terraform doesn't start a run the server can't finish. Requests of running operations
+// like updates and unlocks are still served.
+func refuseLocksWhileShuttingDown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "LOCK" && isShuttingDown() {
+			w.Header().Set("Retry-After", "5")
+			writeStatus(w, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve serves the requests of the listeners until one of them fails or a signal is received.
+// On a signal the listeners are closed and the running requests are drained for at most
+// the drain timeout. The first server is the main server, it serves tls if it has a tls config.
+func serve(servers []*http.Server, listeners []net.Listener, signals <-chan os.Signal, drainTimeout time.Duration) error {
+	var serveErrors = make(chan error, len(servers))
+
+	for i := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- err
+			}
+		}(servers[i], listeners[i])
+	}
+
+	select {
+	case err := <-serveErrors:
+		for _, server := range servers {
+			_ = server.Close()
+		}
+		return err
+	case sig := <-signals:
+		logger.Infof("Received %v, draining requests for at most %v", sig, drainTimeout)
+	}
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var err error
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = fmt.Errorf("requests not finished within %v: %w", drainTimeout, shutdownErr)
+		}
+	}
+	if err != nil {
+		for _, server := range servers {
+			_ = server.Close()
+		}
+		return err
+	}
+	logger.Info("Server stopped")
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_refuseLocksWhileShuttingDown(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	handler := refuseLocksWhileShuttingDown(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("served"))
+	}))
+
+	tests := []struct {
+		name         string
+		method       string
+		shuttingDown int32
+		wantStatus   int
+		wantBody     string
+	}{
+		{"lock while running", "LOCK", 0, 200, "served"},
+		{"lock while shutting down", "LOCK", 1, 503, "Service Unavailable"},
+		{"update while shutting down", "POST", 1, 200, "served"},
+		{"unlock while shutting down", "UNLOCK", 1, 200, "served"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&shuttingDown, tt.shuttingDown)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, "/state", nil))
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+// startTestServer serves the handler with serve and returns the url, the signal channel and the result of serve
+func startTestServer(t *testing.T, handler http.Handler, drainTimeout time.Duration) (string, chan os.Signal, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- serve([]*http.Server{{Handler: handler}}, []net.Listener{listener}, signals, drainTimeout)
+	}()
+
+	return "http://" + listener.Addr().String(), signals, result
+}
+
+func Test_serve(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	started := make(chan struct{})
+	url, signals, result := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("finished"))
+	}), time.Second)
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(url+"/state", "application/json", nil)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body := make([]byte, 20)
+		n, _ := resp.Body.Read(body)
+		responses <- string(body[:n])
+	}()
+	<-started
+	signals <- syscall.SIGTERM
+
+	// the running request is finished before serve returns
+	assert.Nil(t, <-result)
+	assert.Equal(t, "finished", <-responses)
+	assert.True(t, isShuttingDown())
+	_, err := http.Get(url + "/state")
+	assert.Error(t, err)
+	hooks.Reset()
+}
+
+func Test_serve_drainTimeout(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	url, signals, result := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), 50*time.Millisecond)
+
+	go func() {
+		_, _ = http.Get(url + "/state")
+	}()
+	<-started
+	signals <- syscall.SIGTERM
+
+	assert.Error(t, <-result)
+	hooks.Reset()
+}
+
+func Test_serve_listenerError(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = listener.Close()
+
+	err := serve([]*http.Server{{}}, []net.Listener{listener}, make(chan os.Signal), time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite" // register the sqlite database/sql driver
+)
+
+var sqliteMigrations = []string{
+	`CREATE TABLE states (
+		id         TEXT PRIMARY KEY,
+		content    BLOB NOT NULL,
+		size       INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE locks (
+		id         TEXT PRIMARY KEY,
+		lock_id    TEXT NOT NULL,
+		content    BLOB NOT NULL,
+		created_at INTEGER NOT NULL
+	);`,
+	`CREATE TABLE state_versions (
+		id         TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		serial     INTEGER NOT NULL,
+		content    BLOB NOT NULL,
+		size       INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (id, version)
+	);`,
+}
+
+// SQLiteBackend is the "sqlite" storage driver storing the states and locks
+// in tables of a single sqlite database file. Every operation runs in a
+// transaction started with BEGIN IMMEDIATE, so concurrent lock requests are
+// serialized by sqlite itself and can never both succeed.
+type SQLiteBackend struct {
+	db        *sql.DB
+	retention HistoryRetention
+	lockTTL   time.Duration
+}
+
+func init() {
+	RegisterStorageDriver("sqlite", newSQLiteBackend)
+}
+
+func newSQLiteBackend(c *Config) (StateStore, error) {
+	if dir := filepath.Dir(c.sqlitePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	dsn := fmt.Sprintf("file:%s?_txlock=immediate&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", c.sqlitePath)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows only one writer, so all access goes through one connection
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db, "", sqliteMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &SQLiteBackend{db: db, retention: c.getHistoryRetention(), lockTTL: c.lockTTL}, nil
+}
+
+func (s *SQLiteBackend) get(tfID string) ([]byte, error) {
+	var id = normalizeStateID(tfID)
+	var tfstate []byte
+
+	err := s.db.QueryRow("SELECT content FROM states WHERE id = ?", id).Scan(&tfstate)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Infof("State %s not found", id)
+		return nil, &FileNotExistsError{Info: fmt.Sprintf("state %s not found", id)}
+	}
+	if err != nil {
+		logger.Warnf("Can't read state %s. With follow error %v", id, err)
+		return nil, err
+	}
+
+	return tfstate, nil
+}
+
+func (s *SQLiteBackend) update(tfID string, tfstate []byte) error {
+	var id = normalizeStateID(tfID)
+	var now = time.Now()
+
+	err := s.transaction(func(tx *sql.Tx) error {
+		var current []byte
+
+		err := tx.QueryRow("SELECT content FROM states WHERE id = ?", id).Scan(&current)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil && !bytes.Equal(current, tfstate) {
+			if err := s.archive(tx, id, current, now); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(
+			`INSERT INTO states (id, content, size, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET content = excluded.content, size = excluded.size, updated_at = excluded.updated_at`,
+			id, tfstate, len(tfstate), now.UnixNano(), now.UnixNano(),
+		)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Can't write state %s. Got follow error %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// archive keeps the current state as new version and removes the versions outside of the retention
+func (s *SQLiteBackend) archive(tx *sql.Tx, id string, current []byte, now time.Time) error {
+	versions, err := s.queryVersions(tx, id)
+	if err != nil {
+		return err
+	}
+	version := newStateVersion(versions, current, now)
+	if _, err := tx.Exec(
+		"INSERT INTO state_versions (id, version, serial, content, size, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, version.Version, version.Serial, current, version.Size, now.UnixNano(),
+	); err != nil {
+		return err
+	}
+	for _, expired := range s.retention.expired(append(versions, version), now) {
+		if _, err := tx.Exec("DELETE FROM state_versions WHERE id = ? AND version = ?", id, expired.Version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteBackend) versions(tfID string) ([]StateVersion, error) {
+	var id = normalizeStateID(tfID)
+
+	versions, err := s.queryVersions(s.db, id)
+	if err != nil {
+		logger.Warnf("Can't read versions of state %s. With follow error %v", id, err)
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (s *SQLiteBackend) queryVersions(db sqlQuerier, id string) ([]StateVersion, error) {
+	var versions = []StateVersion{}
+
+	rows, err := db.Query("SELECT version, serial, size, created_at FROM state_versions WHERE id = ? ORDER BY version", id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var version StateVersion
+		var created int64
+		if err := rows.Scan(&version.Version, &version.Serial, &version.Size, &created); err != nil {
+			return nil, err
+		}
+		version.Created = time.Unix(0, created).UTC()
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func (s *SQLiteBackend) getVersion(tfID string, version int) ([]byte, error) {
+	var id = normalizeStateID(tfID)
+	var tfstate []byte
+
+	err := s.db.QueryRow("SELECT content FROM state_versions WHERE id = ? AND version = ?", id, version).Scan(&tfstate)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Infof("Version %d of state %s not found", version, id)
+		return nil, &VersionNotExistsError{TfID: id, Version: version}
+	}
+	if err != nil {
+		logger.Warnf("Can't read version %d of state %s. With follow error %v", version, id, err)
+		return nil, err
+	}
+
+	return tfstate, nil
+}
+
+func (s *SQLiteBackend) purge(tfID string) error {
+	var id = normalizeStateID(tfID)
+
+	result, err := s.db.Exec("DELETE FROM states WHERE id = ?", id)
+	if err != nil {
+		logger.Warnf("Can't delete state %s. Got follow error %v", id, err)
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		logger.Infof("State %s not found", id)
+	}
+	return nil
+}
+
+func (s *SQLiteBackend) getLock(tfID string) (*LockInfo, error) {
+	var id = normalizeStateID(tfID)
+	var lock []byte
+	var lockInfo LockInfo
+
+	err := s.db.QueryRow("SELECT content FROM locks WHERE id = ?", id).Scan(&lock)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+		return nil, err
+	}
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	return &lockInfo, nil
+}
+
+func (s *SQLiteBackend) lock(tfID string, lock []byte) ([]byte, error) {
+	var id = normalizeStateID(tfID)
+	var lockInfo LockInfo
+	var result []byte
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return nil, err
+	}
+
+	err := s.transaction(func(tx *sql.Tx) error {
+		var currentLockID string
+		var currentLock []byte
+
+		err := tx.QueryRow("SELECT lock_id, content FROM locks WHERE id = ?", id).Scan(&currentLockID, &currentLock)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := tx.Exec(
+				"INSERT INTO locks (id, lock_id, content, created_at) VALUES (?, ?, ?, ?)",
+				id, lockInfo.ID, lock, time.Now().UnixNano(),
+			); err != nil {
+				logger.Errorf("Can't write lock %s. Got follow error %v", id, err)
+				return err
+			}
+			result = lock
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+			return err
+		}
+		if currentLockID != lockInfo.ID {
+			var currentLockInfo LockInfo
+			_ = json.Unmarshal(currentLock, &currentLockInfo)
+			if !lockExpired(currentLockInfo, s.lockTTL, time.Now()) {
+				logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockID, lockInfo.ID)
+				return newLockConflictError(currentLockInfo)
+			}
+			if _, err := tx.Exec(
+				"UPDATE locks SET lock_id = ?, content = ?, created_at = ? WHERE id = ?",
+				lockInfo.ID, lock, time.Now().UnixNano(), id,
+			); err != nil {
+				logger.Errorf("Can't write lock %s. Got follow error %v", id, err)
+				return err
+			}
+			auditReclaimedLock(id, currentLockInfo, lockInfo.Who)
+			result = lock
+			return nil
+		}
+		if s.lockTTL > 0 {
+			renewed, err := renewLock(currentLock, time.Now())
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE locks SET content = ? WHERE id = ?", renewed, id); err != nil {
+				logger.Errorf("Can't write lock %s. Got follow error %v", id, err)
+				return err
+			}
+			currentLock = renewed
+		}
+		result = currentLock
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *SQLiteBackend) locks() ([]HeldLock, error) {
+	var locks = []HeldLock{}
+
+	rows, err := s.db.Query("SELECT id, content FROM locks ORDER BY id")
+	if err != nil {
+		logger.Warnf("Can't read locks. With follow error %v", err)
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var held HeldLock
+		var lock []byte
+		if err := rows.Scan(&held.StateID, &lock); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(lock, &held.LockInfo); err != nil {
+			logger.Warnf("Ignore lock %s. Got follow error %v", held.StateID, err)
+			continue
+		}
+		locks = append(locks, held)
+	}
+
+	return locks, rows.Err()
+}
+
+func (s *SQLiteBackend) states() ([]string, error) {
+	var states = []string{}
+
+	rows, err := s.db.Query("SELECT id FROM states ORDER BY id")
+	if err != nil {
+		logger.Warnf("Can't read states. With follow error %v", err)
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		states = append(states, id)
+	}
+
+	return states, rows.Err()
+}
+
+func (s *SQLiteBackend) removeLock(tfID string, lockInfo LockInfo) error {
+	var id = normalizeStateID(tfID)
+
+	return s.transaction(func(tx *sql.Tx) error {
+		var currentLock []byte
+		var currentLockInfo LockInfo
+
+		err := tx.QueryRow("SELECT content FROM locks WHERE id = ?", id).Scan(&currentLock)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+			return err
+		}
+		if err := json.Unmarshal(currentLock, &currentLockInfo); err != nil {
+			logger.Errorf("unexpected decoding json error %v", err)
+			return err
+		}
+		if !sameLock(currentLockInfo, lockInfo) {
+			logger.Infof("lock %s changed while removing the lock", id)
+			return newLockConflictError(currentLockInfo)
+		}
+		if _, err := tx.Exec("DELETE FROM locks WHERE id = ?", id); err != nil {
+			logger.Warnf("Can't delete lock %s. Got follow error %v", id, err)
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteBackend) unlock(tfID string, lock []byte) error {
+	var id = normalizeStateID(tfID)
+	var lockInfo LockInfo
+
+	if err := json.Unmarshal(lock, &lockInfo); err != nil {
+		logger.Errorf("unexpected decoding json error %v", err)
+		return err
+	}
+
+	return s.transaction(func(tx *sql.Tx) error {
+		var currentLockID string
+		var currentLock []byte
+
+		err := tx.QueryRow("SELECT lock_id, content FROM locks WHERE id = ?", id).Scan(&currentLockID, &currentLock)
+		if errors.Is(err, sql.ErrNoRows) {
+			logger.Infof("lock %s is deleted so notting to do.", id)
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("Can't read lock %s. With follow error %v", id, err)
+			return err
+		}
+		if currentLockID != lockInfo.ID {
+			var currentLockInfo LockInfo
+			_ = json.Unmarshal(currentLock, &currentLockInfo)
+			logger.Infof("state is locked with diffrend id %s, but follow id requestd lock %s", currentLockID, lockInfo.ID)
+			return newLockConflictError(currentLockInfo)
+		}
+		if _, err := tx.Exec("DELETE FROM locks WHERE id = ?", id); err != nil {
+			logger.Warnf("Can't delete lock %s. Got follow error %v", id, err)
+			return err
+		}
+		return nil
+	})
+}
+
+// ping runs a write statement without changes, which fails for a read-only database
+func (s *SQLiteBackend) ping() error {
+	if err := s.db.Ping(); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	_, err = tx.Exec("DELETE FROM locks WHERE 0")
+
+	return err
+}
+
+// transaction runs fn in a transaction which is committed if fn returns no error
+func (s *SQLiteBackend) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createSQLiteBackend(t *testing.T) (*SQLiteBackend, func()) {
+	tmpTestDir, cleanup := createDirectory()
+
+	store, err := newSQLiteBackend(&Config{sqlitePath: filepath.Join(tmpTestDir, "db", "terraform.db")})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return store.(*SQLiteBackend), func() {
+		_ = store.(*SQLiteBackend).db.Close()
+		cleanup()
+	}
+}
+
+func Test_newSQLiteBackend(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	var version int
+	dbPath := filepath.Join(tmpTestDir, "terraform.db")
+	for i := 0; i < 2; i++ {
+		store, err := newSQLiteBackend(&Config{sqlitePath: dbPath})
+		assert.Nil(t, err)
+		db := store.(*SQLiteBackend).db
+		assert.Nil(t, db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version))
+		assert.Equal(t, len(sqliteMigrations), version)
+		_ = db.Close()
+	}
+	hooks.Reset()
+}
+
+func TestSQLiteBackend_state(t *testing.T) {
+	store, cleanup := createSQLiteBackend(t)
+	defer cleanup()
+
+	_, err := store.get("my_state")
+	var notExists *FileNotExistsError
+	assert.ErrorAs(t, err, &notExists)
+	checkLogMessage(t, []string{"State my_state not found"})
+
+	assert.Nil(t, store.update("my_state", []byte("the content")))
+	assert.Nil(t, store.update("my_state.tfstate", []byte("the new content")))
+	got, err := store.get("my_state")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("the new content"), got)
+
+	assert.Nil(t, store.purge("my_state"))
+	_, err = store.get("my_state")
+	assert.Error(t, err)
+	assert.Nil(t, store.purge("my_state"))
+	hooks.Reset()
+}
+
+func TestSQLiteBackend_lock(t *testing.T) {
+	store, cleanup := createSQLiteBackend(t)
+	defer cleanup()
+
+	lockInfo1Bytes, _ := json.Marshal(LockInfo{"myid1", "START", "ThisInfo", "", "", time.Now(), ""})
+	lockInfo2Bytes, _ := json.Marshal(LockInfo{"myid2", "START", "ThisInfo", "", "", time.Now(), ""})
+
+	current, err := store.getLock("this_state")
+	assert.Nil(t, err)
+	assert.Nil(t, current)
+
+	got, err := store.lock("this_state", lockInfo1Bytes)
+	assert.Nil(t, err)
+	assert.Equal(t, lockInfo1Bytes, got)
+
+	current, err = store.getLock("this_state")
+	assert.Nil(t, err)
+	assert.Equal(t, "myid1", current.ID)
+
+	got, err = store.lock("this_state", lockInfo1Bytes)
+	assert.Nil(t, err)
+	assert.Equal(t, lockInfo1Bytes, got)
+
+	_, err = store.lock("this_state", lockInfo2Bytes)
+	var conflict *ConflictError
+	if assert.ErrorAs(t, err, &conflict) {
+		assert.Equal(t, "myid1", conflict.LockInfo.ID)
+	}
+	checkLogMessage(t, []string{"state is locked with diffrend id myid1, but follow id requestd lock myid2"})
+
+	err = store.unlock("this_state", lockInfo2Bytes)
+	assert.ErrorAs(t, err, &conflict)
+	checkLogMessage(t, []string{"state is locked with diffrend id myid1, but follow id requestd lock myid2"})
+
+	assert.Nil(t, store.unlock("this_state", lockInfo1Bytes))
+	assert.Nil(t, store.unlock("this_state", lockInfo1Bytes))
+	checkLogMessage(t, []string{"lock this_state is deleted so notting to do."})
+
+	_, err = store.lock("this_state", []byte("no json"))
+	assert.Error(t, err)
+	hooks.Reset()
+}
+
+func TestSQLiteBackend_concurrentLock(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	// two stores on the same file simulate two server processes
+	dbPath := filepath.Join(tmpTestDir, "terraform.db")
+	store1, err := newSQLiteBackend(&Config{sqlitePath: dbPath})
+	assert.Nil(t, err)
+	store2, err := newSQLiteBackend(&Config{sqlitePath: dbPath})
+	assert.Nil(t, err)
+	defer func() {
+		_ = store1.(*SQLiteBackend).db.Close()
+		_ = store2.(*SQLiteBackend).db.Close()
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var acquired []string
+	for i := 0; i < 10; i++ {
+		store := store1
+		if i%2 == 0 {
+			store = store2
+		}
+		wg.Add(1)
+		go func(store StateStore, id string) {
+			defer wg.Done()
+			lockBytes, _ := json.Marshal(LockInfo{ID: id, Created: time.Now()})
+			if _, err := store.lock("concurrent_state", lockBytes); err == nil {
+				mu.Lock()
+				acquired = append(acquired, id)
+				mu.Unlock()
+			}
+		}(store, fmt.Sprintf("id%d", i))
+	}
+	wg.Wait()
+
+	assert.Len(t, acquired, 1)
+	hooks.Reset()
+}
+
+func TestSQLiteBackend_versions(t *testing.T) {
+	store, cleanup := createSQLiteBackend(t)
+	defer cleanup()
+
+	store.retention = HistoryRetention{maxVersions: 2}
+	checkStateStoreVersions(t, store)
+}
+
+func TestSQLiteBackend_lockExpiry(t *testing.T) {
+	store, cleanup := createSQLiteBackend(t)
+	defer cleanup()
+
+	store.lockTTL = time.Hour
+	checkStateStoreLockExpiry(t, store)
+}
+
+func TestSQLiteBackend_ping(t *testing.T) {
+	store, cleanup := createSQLiteBackend(t)
+	defer cleanup()
+
+	assert.Nil(t, store.ping())
+	_ = store.db.Close()
+	assert.Error(t, store.ping())
+}
+
+func TestSQLiteBackend_states(t *testing.T) {
+	store, cleanup := createSQLiteBackend(t)
+	defer cleanup()
+
+	checkStateStoreStates(t, store)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// InvalidStateIDError is returned if a state path is not allowed as state id
+type InvalidStateIDError struct {
+	TfID   string
+	Reason string
+}
+
+func (i *InvalidStateIDError) Error() string {
+	return fmt.Sprintf("invalid state id %q: %s", i.TfID, i.Reason)
+}
+
+// stateSubResources are the path segments addressing a sub resource of a state instead of
+// the state itself, together with the number of path segments allowed to follow them.
+// They are reserved and can't be used as segment of a state id, so a path is never ambiguous.
+var stateSubResources = map[string]int{
+	"versions":  1,
+	"rollback":  0,
+	"outputs":   1,
+	"resources": 0,
+	"diff":      0,
+}
+
+// validateStateID checks that a state id like "team/project/env" can be used safely
+// as file path or object key. Beside the rules of validateStatePathSegments the first
+// segment can't be one of the reservedStatePaths of the server and no segment can be
+// one of the stateSubResources.
+func validateStateID(tfID string) error {
+	if tfID == "" {
+		return &InvalidStateIDError{TfID: tfID, Reason: "empty state id"}
+	}
+	if strings.HasPrefix(tfID, "/") {
+		return &InvalidStateIDError{TfID: tfID, Reason: "absolute path"}
+	}
+	if reservedStatePaths[strings.SplitN(normalizeStateID(tfID), "/", 2)[0]] {
+		return &InvalidStateIDError{TfID: tfID, Reason: "reserved path"}
+	}
+	if err := validateStatePathSegments(tfID); err != nil {
+		return err
+	}
+	for _, segment := range strings.Split(normalizeStateID(tfID), "/") {
+		if _, ok := stateSubResources[segment]; ok {
+			return &InvalidStateIDError{TfID: tfID, Reason: fmt.Sprintf("reserved path segment %q", segment)}
+		}
+	}
+
+	return nil
+}
+
+// validateStatePathSegments checks the segments of a path independent of its position
+// below the root. Empty segments, "." and ".." as well as segments starting with a dot,
+// which are reserved for internal data like ".versions", are rejected.
+func validateStatePathSegments(tfID string) error {
+	for _, segment := range strings.Split(tfID, "/") {
+		switch {
+		case segment == "":
+			return &InvalidStateIDError{TfID: tfID, Reason: "empty path segment"}
+		case segment == "." || segment == "..":
+			return &InvalidStateIDError{TfID: tfID, Reason: "relative path segment"}
+		case strings.HasPrefix(segment, "."):
+			return &InvalidStateIDError{TfID: tfID, Reason: "path segment starting with a dot"}
+		case strings.ContainsAny(segment, "\\:"):
+			return &InvalidStateIDError{TfID: tfID, Reason: "path segment with a backslash or colon"}
+		}
+		for _, c := range segment {
+			if c < 0x20 || c == 0x7f {
+				return &InvalidStateIDError{TfID: tfID, Reason: "control character"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// splitStatePath splits the path matched by a route wildcard into its unescaped segments.
+// The router matches the escaped path if the request path contains escaped characters.
+func splitStatePath(r *http.Request, path string) ([]string, error) {
+	var segments = strings.Split(path, "/")
+
+	if r.URL.RawPath == "" {
+		return segments, nil
+	}
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil || strings.Contains(unescaped, "/") {
+			return nil, &InvalidStateIDError{TfID: path, Reason: "invalid escaped path segment"}
+		}
+		segments[i] = unescaped
+	}
+
+	return segments, nil
+}
+
+// parseStatePath splits the segments of a path like "team/project/env/versions/3" into the
+// validated state id "team/project/env" and the sub resource path "/versions/3".
+func parseStatePath(segments []string) (string, string, error) {
+	subResource := "/"
+	for i := len(segments) - 1; i > 0; i-- {
+		if following, ok := stateSubResources[segments[i]]; ok && len(segments)-1-i <= following {
+			subResource = "/" + strings.Join(segments[i:], "/")
+			segments = segments[:i]
+			break
+		}
+	}
+	tfID := strings.Join(segments, "/")
+	if err := validateStateID(tfID); err != nil {
+		return "", "", err
+	}
+
+	return tfID, subResource, nil
+}
+
+// stateRouter serves the states on nested paths like "/team/project/env" matched by a
+// route wildcard. The state id is resolved from the path and passed as url parameter "id"
+// to the routes of the state.
+func stateRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.With(authorizeStateRead).Get("/", getTfstate)
+	r.With(authorize(PermissionWrite)).Post("/", updateTfstate)
+	r.With(authorize(PermissionDelete)).Delete("/", purgeTfstate)
+	r.With(authorize(PermissionLock)).MethodFunc("LOCK", "/", lockTfstate)
+	r.With(authorize(PermissionLock)).MethodFunc("UNLOCK", "/", unlockTfstate)
+	r.With(authorizeRedactedRead).Get("/versions", listTfstateVersions)
+	r.With(authorizeRedactedRead).Get("/versions/{version}", getTfstateVersion)
+	r.With(authorize(PermissionWrite)).Post("/rollback", rollbackTfstate)
+	r.With(authorize(PermissionReadOutputs)).Get("/outputs", getTfstateOutputs)
+	r.With(authorize(PermissionReadOutputs)).Get("/outputs/{name}", getTfstateOutput)
+	r.With(authorize(PermissionRead)).Get("/resources", getTfstateResources)
+	r.With(authorize(PermissionRead)).Get("/diff", getTfstateDiff)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rctx := chi.RouteContext(req.Context())
+		segments, err := splitStatePath(req, chi.URLParam(req, "*"))
+		if err != nil {
+			logger.Infof("Refused request for %s. %v", req.URL.Path, err)
+			writeStatus(w, http.StatusBadRequest)
+			return
+		}
+		tfID, subResource, err := parseStatePath(segments)
+		if err != nil {
+			logger.Infof("Refused request for %s. %v", req.URL.Path, err)
+			writeStatus(w, http.StatusBadRequest)
+			return
+		}
+		rctx.URLParams.Add("id", tfID)
+		rctx.RoutePath = subResource
+		r.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateStateID(t *testing.T) {
+	tests := []struct {
+		name    string
+		tfID    string
+		wantErr bool
+	}{
+		{"single segment", "my_state", false},
+		{"nested", "team/project/env", false},
+		{"with extension", "team/project/env.tfstate", false},
+		{"empty", "", true},
+		{"absolute", "/etc/passwd", true},
+		{"empty segment", "team//env", true},
+		{"trailing slash", "team/env/", true},
+		{"parent directory", "team/../../etc", true},
+		{"current directory", "team/./env", true},
+		{"hidden segment", "team/.versions/env", true},
+		{"backslash", "team\\..\\env", true},
+		{"drive letter", "c:/windows", true},
+		{"control character", "team/env\x00", true},
+		{"reserved path", "healthz", true},
+		{"reserved path with extension", "metrics.tfstate", true},
+		{"below reserved path", "admin/locks", true},
+		{"reserved name nested", "team/healthz", false},
+		{"below resources", "resources/team", true},
+		{"sub resource as last segment", "team/rollback", true},
+		{"diff as last segment", "team/diff", true},
+		{"sub resource with extension", "team/outputs.tfstate", true},
+		{"sub resource as directory", "team/versions/prod", true},
+		{"sub resource as first segment", "rollback/prod", true},
+		{"sub resource as part of segment", "team/diffs/outputs_prod", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var invalid *InvalidStateIDError
+
+			err := validateStateID(tt.tfID)
+			if !tt.wantErr {
+				assert.Nil(t, err)
+				return
+			}
+			assert.ErrorAs(t, err, &invalid)
+		})
+	}
+}
+
+func Test_parseStatePath(t *testing.T) {
+	tests := []struct {
+		name            string
+		path            string
+		wantID          string
+		wantSubResource string
+		wantErr         bool
+	}{
+		{"state", "my_state", "my_state", "/", false},
+		{"nested state", "team/project/env", "team/project/env", "/", false},
+		{"versions", "team/project/env/versions", "team/project/env", "/versions", false},
+		{"version", "team/project/env/versions/3", "team/project/env", "/versions/3", false},
+		{"rollback", "team/env/rollback", "team/env", "/rollback", false},
+		{"outputs", "team/env/outputs", "team/env", "/outputs", false},
+		{"output", "team/env/outputs/vpc_id", "team/env", "/outputs/vpc_id", false},
+		{"resources", "team/env/resources", "team/env", "/resources", false},
+		{"state named like sub resource", "versions", "", "", true},
+		{"segment after rollback", "team/rollback/env", "", "", true},
+		{"output in directory named like sub resource", "x/outputs/prod", "x", "/outputs/prod", false},
+		{"traversal", "../etc/passwd", "", "", true},
+		{"state in directory named like sub resource", "versions/3", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotID, gotSubResource, err := parseStatePath(strings.Split(tt.path, "/"))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantID, gotID)
+			assert.Equal(t, tt.wantSubResource, gotSubResource)
+		})
+	}
+}
+
+func Test_stateRouter(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	lockInfoBytes, _ := json.Marshal(LockInfo{ID: "myid1", Created: time.Now().UTC()})
+	state1, state2 := testTfstate(1, "a1"), testTfstate(2, "a1")
+
+	tests := []struct {
+		name       string
+		method     string
+		suburl     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"get missing nested state", "GET", "/team/project/env", "", 404, "Not Found"},
+		{"lock nested state", "LOCK", "/team/project/env", string(lockInfoBytes), 200, string(lockInfoBytes)},
+		{"update nested state", "POST", "/team/project/env?ID=myid1", state1, 200, state1},
+		{"replace nested state", "POST", "/team/project/env?ID=myid1", state2, 200, state2},
+		{"get nested state", "GET", "/team/project/env", "", 200, state2},
+		{"get nested version", "GET", "/team/project/env/versions/1", "", 200, state1},
+		{"unlock nested state", "UNLOCK", "/team/project/env", string(lockInfoBytes), 200, string(lockInfoBytes)},
+		{"delete nested state", "DELETE", "/team/project/env", "", 200, "{\"state\": \"tfstate deleted\"}"},
+		{"unsupported method", "PUT", "/team/project/env", "", 405, ""},
+		{"escaped segment", "GET", "/team/my%20state", "", 404, "Not Found"},
+		{"escaped traversal", "GET", "/team/%2e%2e/%2e%2e/etc", "", 400, "Bad Request"},
+		{"escaped slash", "GET", "/team%2F..%2F..%2Fetc", "", 400, "Bad Request"},
+		{"hidden segment", "GET", "/.versions/team", "", 400, "Bad Request"},
+		{"root", "GET", "/", "", 400, "Bad Request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			chi.RegisterMethod("LOCK")
+			chi.RegisterMethod("UNLOCK")
+			router := chi.NewRouter()
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testRequest(t, ts, tt.method, tt.suburl, strings.NewReader(tt.body))
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	assert.DirExists(t, filepath.Join(tmpTestDir, "team", "project"))
+	assert.DirExists(t, filepath.Join(tmpTestDir, ".versions", "team", "project", "env"))
+	hooks.Reset()
+}
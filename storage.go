@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StateStore is the interface a storage driver has to implement
+// to serve as storage for the terraform http backend.
+// An update keeps the replaced state as a new version, which can be
+// listed with versions and fetched with getVersion.
+// getLock returns the current lock of a state or nil if it is not locked
+// and locks returns the locks of all states. states returns the ids of all stored states.
+// With a lock ttl a lock older than the ttl is replaced by a lock request
+// with another id and a lock request with the same id renews the lock.
+// removeLock removes the lock only if it is still the given lock, a lock renewed
+// or replaced in the meantime is kept and a ConflictError is returned.
+type StateStore interface {
+	get(tfID string) ([]byte, error)
+	update(tfID string, tfstate []byte) error
+	purge(tfID string) error
+	lock(tfID string, lock []byte) ([]byte, error)
+	unlock(tfID string, lock []byte) error
+	getLock(tfID string) (*LockInfo, error)
+	removeLock(tfID string, lockInfo LockInfo) error
+	locks() ([]HeldLock, error)
+	states() ([]string, error)
+	versions(tfID string) ([]StateVersion, error)
+	getVersion(tfID string, version int) ([]byte, error)
+	// ping checks that the storage is reachable and writable
+	ping() error
+}
+
+// StorageDriver creates a new StateStore from the given configuration
+type StorageDriver func(c *Config) (StateStore, error)
+
+var storageDrivers = make(map[string]StorageDriver)
+
+// RegisterStorageDriver makes a storage driver available under the given name.
+// It is intended to be called from the init function of the driver.
+func RegisterStorageDriver(name string, driver StorageDriver) {
+	if driver == nil {
+		panic("storage driver is nil")
+	}
+	if _, exists := storageDrivers[name]; exists {
+		panic(fmt.Sprintf("storage driver %s is already registered", name))
+	}
+	storageDrivers[name] = driver
+}
+
+// StorageDrivers returns the sorted names of all registered storage drivers
+func StorageDrivers() []string {
+	var names []string
+
+	for name := range storageDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func newStateStore(c *Config) (StateStore, error) {
+	driver, ok := storageDrivers[c.storageDriver]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %q, available drivers are %v", c.storageDriver, StorageDrivers())
+	}
+
+	return driver(c)
+}
+
+// normalizeStateID removes an optional .tfstate extension from the state id
+func normalizeStateID(tfID string) string {
+	return strings.TrimSuffix(tfID, ".tfstate")
+}
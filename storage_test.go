@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterStorageDriver(t *testing.T) {
+	dummyDriver := func(c *Config) (StateStore, error) {
+		return &Backend{dir: c.storageDirectory}, nil
+	}
+	defer delete(storageDrivers, "dummy")
+
+	RegisterStorageDriver("dummy", dummyDriver)
+	assert.Contains(t, StorageDrivers(), "dummy")
+	assert.Panics(t, func() { RegisterStorageDriver("dummy", dummyDriver) })
+	assert.Panics(t, func() { RegisterStorageDriver("nil_driver", nil) })
+}
+
+func Test_newStateStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    StateStore
+		wantErr bool
+	}{
+		{"file driver", Config{storageDriver: "file", storageDirectory: "/tmp/"}, &Backend{dir: "/tmp/"}, false},
+		{"unknown driver", Config{storageDriver: "unknown"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newStateStore(&tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// forceReplaceHeader allows a user with admin permission to upload a state with another
+// lineage or a lower serial than the current state, like for an intentional replacement
+const forceReplaceHeader = "X-Force-State-Replace"
+
+// tfstateHeader holds the fields of a terraform state identifying its history
+type tfstateHeader struct {
+	Version int    `json:"version"`
+	Serial  *int64 `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+// StateConflictError is returned if an uploaded state doesn't continue the history of the current state
+type StateConflictError struct {
+	TfID   string
+	Reason string
+}
+
+func (s *StateConflictError) Error() string {
+	return fmt.Sprintf("state %s can't be replaced: %s", s.TfID, s.Reason)
+}
+
+// validateTfstate checks that the body is a terraform state in the format version 3 or 4 with
+// all required fields, so an empty body or the error page of a proxy can't replace a state
+func validateTfstate(body []byte) error {
+	var state struct {
+		Version          *int            `json:"version"`
+		TerraformVersion *string         `json:"terraform_version"`
+		Serial           *int64          `json:"serial"`
+		Lineage          *string         `json:"lineage"`
+		Outputs          json.RawMessage `json:"outputs"`
+		Resources        json.RawMessage `json:"resources"`
+		Modules          json.RawMessage `json:"modules"`
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return errors.New("empty body")
+	}
+	if body[0] != '{' || !json.Valid(body) {
+		return errors.New("body is no json object")
+	}
+	if err := json.Unmarshal(body, &state); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("field %s has to be of type %s", typeErr.Field, typeErr.Type)
+		}
+		return err
+	}
+	switch {
+	case state.Version == nil:
+		return errors.New("field version missing")
+	case state.TerraformVersion == nil || *state.TerraformVersion == "":
+		return errors.New("field terraform_version missing")
+	case state.Serial == nil:
+		return errors.New("field serial missing")
+	case *state.Serial < 0:
+		return errors.New("field serial is negative")
+	case state.Lineage == nil || *state.Lineage == "":
+		return errors.New("field lineage missing")
+	}
+	switch *state.Version {
+	case 4:
+		if !isJSONKind(state.Outputs, '{') {
+			return errors.New("field outputs has to be an object")
+		}
+		if !isJSONKind(state.Resources, '[') {
+			return errors.New("field resources has to be an array")
+		}
+	case 3:
+		if !isJSONKind(state.Modules, '[') {
+			return errors.New("field modules has to be an array")
+		}
+	default:
+		return fmt.Errorf("unsupported state version %d", *state.Version)
+	}
+
+	return nil
+}
+
+// isJSONKind reports if the json value is an object for '{' or an array for '['
+func isJSONKind(value json.RawMessage, kind byte) bool {
+	return len(value) > 0 && value[0] == kind
+}
+
+func parseTfstateHeader(tfstate []byte) (tfstateHeader, error) {
+	var header tfstateHeader
+
+	err := json.Unmarshal(tfstate, &header)
+
+	return header, err
+}
+
+// currentState returns the stored state or nil if the state doesn't exist
+func currentState(store StateStore, tfID string) ([]byte, error) {
+	var notExists *FileNotExistsError
+
+	current, err := store.get(tfID)
+	if errors.As(err, &notExists) || errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return current, err
+}
+
+// checkStateSuccession refuses an upload with another lineage or a lower serial than the
+// current state, which would rewind the infrastructure to an outdated state. States which
+// can't be parsed are not checked.
+func checkStateSuccession(tfID string, current []byte, upload []byte) error {
+	if current == nil {
+		return nil
+	}
+	currentHeader, err := parseTfstateHeader(current)
+	if err != nil {
+		return nil
+	}
+	uploadHeader, err := parseTfstateHeader(upload)
+	if err != nil {
+		return nil
+	}
+	if currentHeader.Lineage != "" && uploadHeader.Lineage != currentHeader.Lineage {
+		return &StateConflictError{TfID: tfID, Reason: fmt.Sprintf("lineage %q differs from the current lineage %q", uploadHeader.Lineage, currentHeader.Lineage)}
+	}
+	if currentHeader.Serial != nil && (uploadHeader.Serial == nil || *uploadHeader.Serial < *currentHeader.Serial) {
+		var serial int64
+		if uploadHeader.Serial != nil {
+			serial = *uploadHeader.Serial
+		}
+		return &StateConflictError{TfID: tfID, Reason: fmt.Sprintf("serial %d is lower than the current serial %d", serial, *currentHeader.Serial)}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkStateSuccession(t *testing.T) {
+	current := `{"version": 4, "serial": 5, "lineage": "a1"}`
+	tests := []struct {
+		name       string
+		current    string
+		upload     string
+		wantReason string
+	}{
+		{"new state", "", `{"version": 4, "serial": 0, "lineage": "a1"}`, ""},
+		{"next serial", current, `{"version": 4, "serial": 6, "lineage": "a1"}`, ""},
+		{"same serial", current, `{"version": 4, "serial": 5, "lineage": "a1"}`, ""},
+		{"lower serial", current, `{"version": 4, "serial": 4, "lineage": "a1"}`, `serial 4 is lower than the current serial 5`},
+		{"missing serial", current, `{"version": 4, "lineage": "a1"}`, `serial 0 is lower than the current serial 5`},
+		{"other lineage", current, `{"version": 4, "serial": 6, "lineage": "b2"}`, `lineage "b2" differs from the current lineage "a1"`},
+		{"missing lineage", current, `{"version": 4, "serial": 6}`, `lineage "" differs from the current lineage "a1"`},
+		{"current without lineage", `{"serial": 1}`, `{"serial": 2, "lineage": "a1"}`, ""},
+		{"current not parsable", "old content", `{"serial": 1, "lineage": "a1"}`, ""},
+		{"upload not parsable", current, "new content", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var currentState []byte
+			if tt.current != "" {
+				currentState = []byte(tt.current)
+			}
+
+			err := checkStateSuccession("team/env", currentState, []byte(tt.upload))
+			if tt.wantReason == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Equal(t, &StateConflictError{TfID: "team/env", Reason: tt.wantReason}, err)
+		})
+	}
+}
+
+func Test_updateTfstate_succession(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createFile(tmpTestDir, "acl.yaml", testACLPolicy)
+	policy, _ := loadACLPolicy(tmpTestDir + "acl.yaml")
+	defer func() {
+		accessPolicy = nil
+	}()
+	current, stale := testTfstate(5, "a1"), testTfstate(3, "a1")
+
+	tests := []struct {
+		name       string
+		policy     *ACLPolicy
+		username   string
+		state      string
+		body       string
+		force      bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"next serial", nil, "", "team-a/project/env", testTfstate(6, "a1"), false, 200, testTfstate(6, "a1")},
+		{"stale serial", nil, "", "team-a/project/env", stale, false, 409, "Conflict: serial 3 is lower than the current serial 5"},
+		{"other lineage", nil, "", "team-a/project/env", testTfstate(6, "b2"), false, 409, `Conflict: lineage "b2" differs from the current lineage "a1"`},
+		{"forced without policy", nil, "", "team-a/project/env", stale, true, 200, stale},
+		{"forced without admin permission", policy, "alice", "team-a/project/env", stale, true, 403, "Forbidden: user alice has no admin permission on state team-a/project/env"},
+		{"forced with admin permission", policy, "bob", "team-b/project/prod", stale, true, 200, stale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createDirectoryFile(tmpTestDir, "team-a/project", "env.tfstate", current)
+			createDirectoryFile(tmpTestDir, "team-b/project", "prod.tfstate", current)
+			storageBackend = &Backend{dir: tmpTestDir}
+			accessPolicy = tt.policy
+			router := chi.NewRouter()
+			if tt.username != "" {
+				router.Use(authenticate("restricted access", newStaticAuthenticator(map[string]string{"alice": "secret", "bob": "secret"})))
+			}
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			req, _ := http.NewRequest("POST", ts.URL+"/"+tt.state, strings.NewReader(tt.body))
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, "secret")
+			}
+			if tt.force {
+				req.Header.Set(forceReplaceHeader, "true")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body := make([]byte, 200)
+			n, _ := resp.Body.Read(body)
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantBody, string(body[:n]))
+		})
+	}
+	assert.Equal(t, "state_force_replaced", hooks.LastEntry().Data["event"])
+	assert.Equal(t, "bob", hooks.LastEntry().Data["who"])
+	hooks.Reset()
+}
+
+func Test_validateTfstate(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"state", testTfstate(1, "a1"), ""},
+		{"state with resources", `{"version": 4, "terraform_version": "1.5.7", "serial": 3, "lineage": "a1", "outputs": {"ip": {"value": "10.0.0.1", "type": "string"}}, "resources": [{"mode": "managed", "type": "null_resource", "name": "test", "instances": []}]}`, ""},
+		{"version 3 state", `{"version": 3, "terraform_version": "0.11.14", "serial": 1, "lineage": "a1", "modules": []}`, ""},
+		{"empty body", " \n", "empty body"},
+		{"html", "<html>Bad Gateway</html>", "body is no json object"},
+		{"truncated", `{"version": 4, "terraform_version": "1.5.7", "serial": 1, "lin`, "body is no json object"},
+		{"array", `[]`, "body is no json object"},
+		{"missing version", `{"terraform_version": "1.5.7", "serial": 1, "lineage": "a1", "outputs": {}, "resources": []}`, "field version missing"},
+		{"missing terraform version", `{"version": 4, "serial": 1, "lineage": "a1", "outputs": {}, "resources": []}`, "field terraform_version missing"},
+		{"missing serial", `{"version": 4, "terraform_version": "1.5.7", "lineage": "a1", "outputs": {}, "resources": []}`, "field serial missing"},
+		{"negative serial", `{"version": 4, "terraform_version": "1.5.7", "serial": -1, "lineage": "a1", "outputs": {}, "resources": []}`, "field serial is negative"},
+		{"serial as string", `{"version": 4, "terraform_version": "1.5.7", "serial": "1", "lineage": "a1", "outputs": {}, "resources": []}`, "field serial has to be of type int64"},
+		{"missing lineage", `{"version": 4, "terraform_version": "1.5.7", "serial": 1, "outputs": {}, "resources": []}`, "field lineage missing"},
+		{"missing outputs", `{"version": 4, "terraform_version": "1.5.7", "serial": 1, "lineage": "a1", "resources": []}`, "field outputs has to be an object"},
+		{"resources as object", `{"version": 4, "terraform_version": "1.5.7", "serial": 1, "lineage": "a1", "outputs": {}, "resources": {}}`, "field resources has to be an array"},
+		{"version 3 without modules", `{"version": 3, "terraform_version": "0.11.14", "serial": 1, "lineage": "a1"}`, "field modules has to be an array"},
+		{"unknown version", `{"version": 5, "terraform_version": "2.0.0", "serial": 1, "lineage": "a1"}`, "unsupported state version 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTfstate([]byte(tt.body))
+			if tt.wantErr == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateReloader serves the certificate of the server and reads the certificate
+// and key files again if one of them has been changed, so a renewed certificate is
+// used without restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	c := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certificateReloader) fileModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+
+	for i, filename := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// load reads the certificate and key files
+func (c *certificateReloader) load() error {
+	modTimes, err := c.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load certificate %s: %w", c.certFile, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTimes = modTimes
+
+	return nil
+}
+
+// reloadIfChanged reads the certificate again if the modification time of the certificate
+// or key file has changed. On errors the certificate read before is kept.
+func (c *certificateReloader) reloadIfChanged() {
+	modTimes, err := c.fileModTimes()
+	if err != nil {
+		logger.Warnf("Can't read certificate %s. Got follow error %v", c.certFile, err)
+		return
+	}
+	c.mu.RLock()
+	changed := modTimes != c.modTimes
+	c.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := c.load(); err != nil {
+		logger.Warnf("Can't reload certificate %s. Got follow error %v", c.certFile, err)
+		return
+	}
+	logger.Infof("Reloaded certificate %s", c.certFile)
+}
+
+// getCertificate is used as tls.Config.GetCertificate
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.reloadIfChanged()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// loadCertPool reads the pem encoded ca certificates of the file
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+
+	return pool, nil
+}
+
+// clientCertAuthenticator uses the verified client certificate of a mutual tls connection as identity.
+// The name is the common name of the subject or the first subject alternative name, the
+// organizational units of the subject are the groups.
+type clientCertAuthenticator struct{}
+
+func (clientCertAuthenticator) authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := certificateName(cert)
+	if name == "" {
+		return nil, errors.New("client certificate has no subject name")
+	}
+
+	return &Identity{Name: name, Method: "certificate", Groups: cert.Subject.OrganizationalUnit}, nil
+}
+
+func certificateName(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
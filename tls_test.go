@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// createTestCertificate creates a certificate signed by the parent or a self signed ca without parent
+func createTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func Test_certificateReloader(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	ca := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, nil)
+	first := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "first"}}, &ca)
+	second := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "second"}}, &ca)
+	createFile(tmpTestDir, "server.crt", string(first.certPEM))
+	createFile(tmpTestDir, "server.key", string(first.keyPEM))
+
+	_, err := newCertificateReloader(tmpTestDir+"missing.crt", tmpTestDir+"server.key")
+	assert.Error(t, err)
+	_, err = newCertificateReloader(tmpTestDir+"server.crt", tmpTestDir+"server.crt")
+	assert.Error(t, err)
+
+	reloader, err := newCertificateReloader(tmpTestDir+"server.crt", tmpTestDir+"server.key")
+	assert.Nil(t, err)
+	cert, _ := reloader.getCertificate(nil)
+	assert.Equal(t, first.cert.Raw, cert.Certificate[0])
+
+	// a certificate without its key is not used
+	createFile(tmpTestDir, "server.crt", string(second.certPEM))
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(tmpTestDir+"server.crt", future, future)
+	cert, _ = reloader.getCertificate(nil)
+	assert.Equal(t, first.cert.Raw, cert.Certificate[0])
+	assert.Contains(t, hooks.LastEntry().Message, "Can't reload certificate "+tmpTestDir+"server.crt.")
+
+	createFile(tmpTestDir, "server.key", string(second.keyPEM))
+	_ = os.Chtimes(tmpTestDir+"server.key", future, future)
+	cert, _ = reloader.getCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+	hooks.Reset()
+}
+
+func Test_certificateName(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/ci")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.com"}}, "alice"},
+		{"dns name", &x509.Certificate{DNSNames: []string{"ci.example.com"}}, "ci.example.com"},
+		{"email", &x509.Certificate{EmailAddresses: []string{"bob@example.com"}}, "bob@example.com"},
+		{"uri", &x509.Certificate{URIs: []*url.URL{uri}}, "spiffe://example.com/ci"},
+		{"no name", &x509.Certificate{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, certificateName(tt.cert))
+		})
+	}
+}
+
+func TestConfig_getTLSConfig(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	ca := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, nil)
+	server := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}}, &ca)
+	createFile(tmpTestDir, "ca.crt", string(ca.certPEM))
+	createFile(tmpTestDir, "server.crt", string(server.certPEM))
+	createFile(tmpTestDir, "server.key", string(server.keyPEM))
+
+	tests := []struct {
+		name           string
+		config         Config
+		wantTLS        bool
+		wantClientAuth tls.ClientAuthType
+		wantErr        bool
+	}{
+		{"no tls", Config{}, false, tls.NoClientCert, false},
+		{"tls", Config{tlsCert: tmpTestDir + "server.crt", tlsKey: tmpTestDir + "server.key"}, true, tls.NoClientCert, false},
+		{"missing key", Config{tlsCert: tmpTestDir + "server.crt"}, false, tls.NoClientCert, true},
+		{"client ca without certificate", Config{tlsClientCA: tmpTestDir + "ca.crt"}, false, tls.NoClientCert, true},
+		{"required client certificate", Config{tlsCert: tmpTestDir + "server.crt", tlsKey: tmpTestDir + "server.key", tlsClientCA: tmpTestDir + "ca.crt", tlsClientAuth: "require"}, true, tls.RequireAndVerifyClientCert, false},
+		{"optional client certificate", Config{tlsCert: tmpTestDir + "server.crt", tlsKey: tmpTestDir + "server.key", tlsClientCA: tmpTestDir + "ca.crt", tlsClientAuth: "optional"}, true, tls.VerifyClientCertIfGiven, false},
+		{"unknown client auth", Config{tlsCert: tmpTestDir + "server.crt", tlsKey: tmpTestDir + "server.key", tlsClientCA: tmpTestDir + "ca.crt", tlsClientAuth: "maybe"}, false, tls.NoClientCert, true},
+		{"invalid client ca", Config{tlsCert: tmpTestDir + "server.crt", tlsKey: tmpTestDir + "server.key", tlsClientCA: tmpTestDir + "server.key", tlsClientAuth: "require"}, false, tls.NoClientCert, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tt.config.getTLSConfig()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			if !tt.wantTLS {
+				assert.Nil(t, tlsConfig)
+				return
+			}
+			assert.Equal(t, tt.wantClientAuth, tlsConfig.ClientAuth)
+		})
+	}
+}
+
+func Test_clientCertAuthenticator(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	ca := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, nil)
+	otherCA := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other ca"}}, nil)
+	server := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}, DNSNames: []string{"localhost"}}, &ca)
+	client := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner", OrganizationalUnit: []string{"team-a"}}}, &ca)
+	foreignClient := createTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}}, &otherCA)
+	createFile(tmpTestDir, "ca.crt", string(ca.certPEM))
+	createFile(tmpTestDir, "server.crt", string(server.certPEM))
+	createFile(tmpTestDir, "server.key", string(server.keyPEM))
+
+	c := Config{tlsCert: tmpTestDir + "server.crt", tlsKey: tmpTestDir + "server.key", tlsClientCA: tmpTestDir + "ca.crt",
+		tlsClientAuth: "optional", username: "admin", password: "secret"}
+	tlsConfig, err := c.getTLSConfig()
+	assert.Nil(t, err)
+	authenticators, err := c.getAuthenticators()
+	assert.Nil(t, err)
+	ts := httptest.NewUnstartedServer(authenticate("test", authenticators...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := requestIdentity(r)
+		_, _ = w.Write([]byte(identity.Method + ":" + identity.Name + ":" + fmtGroups(identity.Groups)))
+	})))
+	ts.TLS = tlsConfig
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	// httptest adds its own certificate, which is only replaced by the reloaded certificate with sni
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tests := []struct {
+		name       string
+		clientCert *testCertificate
+		password   string
+		wantStatus int
+		wantBody   string
+	}{
+		{"client certificate", &client, "", http.StatusOK, "certificate:ci-runner:team-a"},
+		{"client certificate before password", &client, "secret", http.StatusOK, "certificate:ci-runner:team-a"},
+		{"password without certificate", nil, "secret", http.StatusOK, "basic:admin:"},
+		{"no credentials", nil, "", http.StatusUnauthorized, "Unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.clientCert != nil {
+				clientTLS.Certificates = []tls.Certificate{{Certificate: [][]byte{tt.clientCert.cert.Raw}, PrivateKey: tt.clientCert.key}}
+			}
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			if tt.password != "" {
+				req.SetBasicAuth("admin", tt.password)
+			}
+			resp, err := httpClient.Do(req)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body := make([]byte, 100)
+			n, _ := resp.Body.Read(body)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantBody, string(body[:n]))
+		})
+	}
+
+	// a certificate of an unknown ca is refused by the tls handshake
+	clientTLS := &tls.Config{RootCAs: roots, ServerName: "localhost", GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{Certificate: [][]byte{foreignClient.cert.Raw}, PrivateKey: foreignClient.key}, nil
+	}}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	_, err = httpClient.Get(ts.URL)
+	assert.Error(t, err)
+	hooks.Reset()
+}
+
+func fmtGroups(groups []string) string {
+	if len(groups) == 0 {
+		return ""
+	}
+	return groups[0]
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tokenPrefix marks an api token, so it can be told apart from a password in basic auth
+const tokenPrefix = "tfb_"
+
+// TokenScope allows a token the permissions on the states matching one of the path patterns
+type TokenScope struct {
+	Paths       []string     `json:"paths"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// APIToken is an api token of a user. Only the sha256 hash of the secret is stored.
+type APIToken struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	User    string       `json:"user"`
+	Scopes  []TokenScope `json:"scopes"`
+	Created time.Time    `json:"created"`
+	// Expires is the expiry of the token, the zero value never expires
+	Expires time.Time `json:"expires,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// Duration is a time.Duration encoded as string like "720h" in json
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration like "720h"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+
+	return nil
+}
+
+// TokenRequest is the body of a request to create a token
+type TokenRequest struct {
+	Name      string       `json:"name"`
+	User      string       `json:"user"`
+	Scopes    []TokenScope `json:"scopes"`
+	ExpiresIn Duration     `json:"expires_in"`
+}
+
+// CreatedToken is the answer of a created token with the secret token, which is only shown once
+type CreatedToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// TokenNotExistsError is returned if a token to revoke is not known
+type TokenNotExistsError struct {
+	ID string
+}
+
+func (t *TokenNotExistsError) Error() string {
+	return fmt.Sprintf("token %s not found", t.ID)
+}
+
+func (t APIToken) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// scopesAllow reports if one of the scopes grants the permission on the state
+func scopesAllow(scopes []TokenScope, tfID string, permission Permission) bool {
+	for _, scope := range scopes {
+		if !grantsPermission(scope.Permissions, permission) {
+			continue
+		}
+		for _, pattern := range scope.Paths {
+			if matchStatePattern(pattern, normalizeStateID(tfID)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TokenStore keeps the api tokens in a json file. The file is read again if it has
+// been changed, so tokens created or revoked on the command line are used without restart.
+type TokenStore struct {
+	path    string
+	mu      sync.RWMutex
+	tokens  map[string]APIToken
+	modTime time.Time
+	size    int64
+}
+
+var apiTokens *TokenStore
+
+func newTokenStore(path string) (*TokenStore, error) {
+	t := &TokenStore{path: path, tokens: make(map[string]APIToken)}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// load reads the tokens of the file, a not existing file has no tokens
+func (t *TokenStore) load() error {
+	var tokens []APIToken
+
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return fmt.Errorf("can't parse token file %s: %w", t.path, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = make(map[string]APIToken)
+	for _, token := range tokens {
+		t.tokens[token.ID] = token
+	}
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+
+	return nil
+}
+
+// reloadIfChanged reads the token file again if its modification time or size has changed.
+// On errors the tokens read before are kept.
+func (t *TokenStore) reloadIfChanged() {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return
+	}
+	t.mu.RLock()
+	changed := !info.ModTime().Equal(t.modTime) || info.Size() != t.size
+	t.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := t.load(); err != nil {
+		logger.Warnf("Can't reload token file %s. Got follow error %v", t.path, err)
+	}
+}
+
+// save replaces the token file with all tokens, the caller has to hold the write lock
+func (t *TokenStore) save() error {
+	var tokens = make([]APIToken, 0, len(t.tokens))
+
+	for _, token := range t.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	content, _ := json.MarshalIndent(tokens, "", "  ")
+
+	if err := writeFileAtomic(t.path, content, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(t.path); err == nil {
+		t.modTime = info.ModTime()
+		t.size = info.Size()
+	}
+
+	return nil
+}
+
+// create generates a new token and returns it together with its secret, which is not stored
+func (t *TokenStore) create(name string, user string, scopes []TokenScope, ttl time.Duration) (APIToken, string, error) {
+	if user == "" {
+		return APIToken{}, "", errors.New("token needs a user")
+	}
+	if len(scopes) == 0 {
+		return APIToken{}, "", errors.New("token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if err := validateGrant(scope.Paths, scope.Permissions); err != nil {
+			return APIToken{}, "", fmt.Errorf("invalid scope: %w", err)
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return APIToken{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return APIToken{}, "", err
+	}
+	token := APIToken{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		User:    user,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		token.Expires = token.Created.Add(ttl)
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	token.Hash = hashTokenSecret(encodedSecret)
+
+	t.reloadIfChanged()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[token.ID] = token
+	if err := t.save(); err != nil {
+		delete(t.tokens, token.ID)
+		return APIToken{}, "", err
+	}
+
+	return token, tokenPrefix + token.ID + "_" + encodedSecret, nil
+}
+
+// revoke removes the token with the given id
+func (t *TokenStore) revoke(id string) (APIToken, error) {
+	t.reloadIfChanged()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token, exists := t.tokens[id]
+	if !exists {
+		return APIToken{}, &TokenNotExistsError{ID: id}
+	}
+	delete(t.tokens, id)
+	if err := t.save(); err != nil {
+		t.tokens[id] = token
+		return APIToken{}, err
+	}
+
+	return token, nil
+}
+
+// list returns all tokens without their hashes sorted by the creation time
+func (t *TokenStore) list() []APIToken {
+	var tokens = []APIToken{}
+
+	t.reloadIfChanged()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, token := range t.tokens {
+		token.Hash = ""
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+
+	return tokens
+}
+
+// createToken creates a token and records it in the audit log
+func createToken(store *TokenStore, request TokenRequest, who string) (APIToken, string, error) {
+	token, secret, err := store.create(request.Name, request.User, request.Scopes, request.ExpiresIn.Duration)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	audit("token_created", who, logrus.Fields{"token_id": token.ID, "token_name": token.Name, "token_user": token.User, "expires": token.Expires},
+		"token %s (%s) of user %s created by %s", token.ID, token.Name, token.User, who)
+
+	return token, secret, nil
+}
+
+// revokeToken revokes a token and records it in the audit log
+func revokeToken(store *TokenStore, id string, who string) (APIToken, error) {
+	token, err := store.revoke(id)
+	if err != nil {
+		return APIToken{}, err
+	}
+	audit("token_revoked", who, logrus.Fields{"token_id": token.ID, "token_name": token.Name, "token_user": token.User},
+		"token %s (%s) of user %s revoked by %s", token.ID, token.Name, token.User, who)
+
+	return token, nil
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *TokenStore) authenticate(r *http.Request) (*Identity, error) {
+	value, ok := requestBearer(r)
+	if !ok || !strings.HasPrefix(value, tokenPrefix) {
+		return nil, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCredentials
+	}
+	t.reloadIfChanged()
+
+	t.mu.RLock()
+	token, exists := t.tokens[parts[0]]
+	t.mu.RUnlock()
+	if !exists || subtle.ConstantTimeCompare([]byte(hashTokenSecret(parts[1])), []byte(token.Hash)) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	if token.expired(time.Now()) {
+		return nil, fmt.Errorf("token %s of user %s is expired", token.ID, token.User)
+	}
+
+	// a token without scopes has no access instead of an unlimited access
+	scopes := token.Scopes
+	if scopes == nil {
+		scopes = []TokenScope{}
+	}
+
+	return &Identity{Name: token.User, Method: "token", Scopes: scopes}, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenStore(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	store, err := newTokenStore(tmpTestDir + "tokens.json")
+	assert.Nil(t, err)
+	assert.Equal(t, []APIToken{}, store.list())
+
+	scopes := []TokenScope{{Paths: []string{"team-a/**"}, Permissions: []Permission{PermissionRead}}}
+	_, _, err = store.create("ci", "", scopes, 0)
+	assert.EqualError(t, err, "token needs a user")
+	_, _, err = store.create("ci", "alice", nil, 0)
+	assert.EqualError(t, err, "token needs at least one scope")
+	_, _, err = store.create("ci", "alice", []TokenScope{{Paths: []string{"**"}, Permissions: []Permission{"execute"}}}, 0)
+	assert.EqualError(t, err, "invalid scope: unknown permission \"execute\"")
+
+	token, secret, err := store.create("ci", "alice", scopes, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, tokenPrefix+token.ID+"_", secret[:len(tokenPrefix)+len(token.ID)+1])
+	assert.NotContains(t, token.Hash, secret)
+	assert.Equal(t, token.Created.Add(time.Hour), token.Expires)
+
+	// a second store on the same file sees the created token
+	other, err := newTokenStore(tmpTestDir + "tokens.json")
+	assert.Nil(t, err)
+	listed := other.list()
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, token.ID, listed[0].ID)
+		assert.Equal(t, "", listed[0].Hash)
+	}
+
+	_, err = other.revoke(token.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []APIToken{}, store.list())
+	_, err = store.revoke(token.ID)
+	var notExists *TokenNotExistsError
+	assert.ErrorAs(t, err, &notExists)
+
+	createFile(tmpTestDir, "defect.json", "no json")
+	_, err = newTokenStore(tmpTestDir + "defect.json")
+	assert.Error(t, err)
+}
+
+func TestTokenStore_authenticate(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	store, _ := newTokenStore(tmpTestDir + "tokens.json")
+	scopes := []TokenScope{{Paths: []string{"team-a/**"}, Permissions: []Permission{PermissionRead}}}
+	_, secret, _ := store.create("ci", "alice", scopes, time.Hour)
+	expired, expiredSecret, _ := store.create("old", "bob", scopes, time.Hour)
+	expired.Expires = time.Now().Add(-time.Minute)
+	store.tokens[expired.ID] = expired
+
+	tests := []struct {
+		name         string
+		bearer       string
+		username     string
+		password     string
+		wantIdentity *Identity
+		wantErr      bool
+	}{
+		{"without credentials", "", "", "", nil, false},
+		{"password of basic auth", "", "alice", "secret", nil, false},
+		{"bearer token", secret, "", "", &Identity{Name: "alice", Method: "token", Scopes: scopes}, false},
+		{"token as password of basic auth", "", "token", secret, &Identity{Name: "alice", Method: "token", Scopes: scopes}, false},
+		{"wrong secret", secret[:len(secret)-2] + "xx", "", "", nil, true},
+		{"unknown token", tokenPrefix + "unknown_secret", "", "", nil, true},
+		{"no api token", "some.jwt.token", "", "", nil, false},
+		{"expired token", expiredSecret, "", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.username != "" {
+				r.SetBasicAuth(tt.username, tt.password)
+			}
+			identity, err := store.authenticate(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantIdentity, identity)
+		})
+	}
+}
+
+func Test_authorizeTokenScopes(t *testing.T) {
+	tmpTestDir, cleanup := createDirectory()
+	defer cleanup()
+
+	createDirectoryFile(tmpTestDir, "team-a/project", "env.tfstate", `{"serial": 1}`)
+	createDirectoryFile(tmpTestDir, "team-b/project", "env.tfstate", `{"serial": 1}`)
+	tokens, _ := newTokenStore(tmpTestDir + "tokens.json")
+	_, secret, _ := tokens.create("ci", "alice", []TokenScope{{Paths: []string{"team-a/**"}, Permissions: []Permission{PermissionRead}}}, 0)
+
+	tests := []struct {
+		name       string
+		method     string
+		suburl     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"read in scope", "GET", "/team-a/project/env", 200, `{"serial": 1}`},
+		{"write in scope", "POST", "/team-a/project/env", 403, "Forbidden: token of user alice has no write scope on state team-a/project/env"},
+		{"read outside scope", "GET", "/team-b/project/env", 403, "Forbidden: token of user alice has no read scope on state team-b/project/env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageBackend = &Backend{dir: tmpTestDir}
+			router := chi.NewRouter()
+			router.Use(authenticate("restricted access", tokens))
+			router.Handle("/*", stateRouter())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			rr, got := testAuthRequest(t, ts, tt.method, tt.suburl, strings.NewReader("{}"), "token", secret)
+			assert.Equal(t, tt.wantStatus, rr.StatusCode)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+	hooks.Reset()
+}
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	var request TokenRequest
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"expires_in": "720h"}`), &request))
+	assert.Equal(t, 720*time.Hour, request.ExpiresIn.Duration)
+	assert.Error(t, json.Unmarshal([]byte(`{"expires_in": "forever"}`), &request))
+	assert.Error(t, json.Unmarshal([]byte(`{"expires_in": 5}`), &request))
+}